@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* isAdmin returns true if from (nick!user@host) matches one of the -admin
+masks */
+func isAdmin(from string) bool {
+	for _, m := range st.admins {
+		if matchMask(strings.ToLower(m), strings.ToLower(from)) {
+			return true
+		}
+	}
+	return false
+}
+
+/* matchMask returns true if s matches the IRC mask m, in which * matches any
+number of characters and ? matches exactly one.  Nothing else is special, so
+the [ and ] allowed in nicks and the \ in some idents match themselves. */
+func matchMask(m, s string) bool {
+	/* Where to go back to if a * needs to match more */
+	star, next := -1, 0
+	i, j := 0, 0
+	for j < len(s) {
+		switch {
+		case i < len(m) && '*' == m[i]:
+			star, next = i, j
+			i++
+		case i < len(m) && ('?' == m[i] || m[i] == s[j]):
+			i++
+			j++
+		case -1 != star:
+			next++
+			i, j = star+1, next
+		default:
+			return false
+		}
+	}
+	/* Trailing *'s match nothing */
+	for i < len(m) && '*' == m[i] {
+		i++
+	}
+	return len(m) == i
+}
+
+/* handleAdmin handles the command in text from from (nick!user@host), whose
+nick is nick.  Commands from non-admins are silently ignored.  If the command
+asks for a reconnect, reconnect will be true. */
+func handleAdmin(irc ircConn, from, nick, text string) (
+	reconnect bool, err error) {
+	/* Only commands from admins are interesting */
+	f := strings.Fields(text)
+	if 0 == len(f) || !strings.HasPrefix(f[0], "!") || !isAdmin(from) {
+		return false, nil
+	}
+	var r string
+	switch strings.ToLower(f[0]) {
+	case "!status":
+		r = status(irc)
+	case "!uptime":
+		r = fmt.Sprintf("Up %v, connected %v",
+			since(st.started), since(st.connected))
+	case "!reconnect":
+		verbose("Reconnect requested by %v", from)
+		noteEvent("Reconnect requested by %v", from)
+		r = "Reconnecting"
+		reconnect = true
+	case "!history":
+		ls := history(historyCount(f[1:]))
+		if 0 == len(ls) {
+			r = "No errors or reconnects"
+			break
+		}
+		debug("Admin command %q from %v", text, from)
+		/* Paced like everything else */
+		for _, l := range ls {
+			st.outbox = append(st.outbox, outMsg{
+				text:   l,
+				target: nick,
+				notice: true,
+			})
+		}
+		return false, nil
+	case "!mute":
+		setMute(true, from)
+		r = "Muted"
+	case "!unmute":
+		setMute(false, from)
+		r = "Unmuted"
+	default:
+		r = "Unknown command " + f[0] + ".  Try !status, !uptime, " +
+			"!reconnect, !history, !mute, or !unmute."
+	}
+	debug("Admin command %q from %v: %v", text, from, r)
+	if isAway(nick) {
+		verbose("Replying to %v, who's away", nick)
+	}
+	return reconnect, notice(irc, r, nick)
+}
+
+/* status returns a short summary of what we're up to */
+func status(irc ircConn) string {
+	return fmt.Sprintf("Nick %v on %v, %v lines sent (%v in the last "+
+		"%v), %v reconnects, connected %v, %v, %v", ourNick(irc),
+		*gc.host, st.lines, observedRate(), ratewindow, st.reconnects,
+		since(st.connected), chanStatus(), muteStatus())
+}
+
+/* since returns the time since t, to the second */
+func since(t time.Time) time.Duration {
+	if t.IsZero() {
+		return 0
+	}
+	return time.Since(t) / time.Second * time.Second
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestHistoryQueued(t *testing.T) {
+	setup(t)
+	st.admins = []string{"admin!*@*"}
+	noteEvent("first")
+	noteEvent("second")
+	f := newFakeIRC("testnick")
+
+	/* The history should wait its turn in the outbox */
+	if _, err := handleAdmin(f, "admin!u@h", "admin",
+		"!history"); nil != err {
+		t.Fatalf("Error handling !history: %v", err)
+	}
+	if 0 != len(f.sent) {
+		t.Fatalf("History sent straight away: %q", f.sent)
+	}
+	if 2 != len(st.outbox) {
+		t.Fatalf("Queued %v messages, not 2", len(st.outbox))
+	}
+	for _, m := range st.outbox {
+		if !m.notice || "admin" != m.target {
+			t.Fatalf("Queued %+v, not a notice to admin", m)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "strings"
+
+/* noteAway notes whether nick is away, as told by away-notify */
+func noteAway(nick string, away bool) {
+	if nil == st.away {
+		st.away = make(map[string]bool)
+	}
+	k := strings.ToLower(nick)
+	if away {
+		debug("%v is away", nick)
+		st.away[k] = true
+	} else {
+		debug("%v is back", nick)
+		delete(st.away, k)
+	}
+}
+
+/* renameAway carries over the away state of a nick which changed from old
+to new */
+func renameAway(old, new string) {
+	if !isAway(old) {
+		return
+	}
+	noteAway(old, false)
+	noteAway(new, true)
+}
+
+/* isAway returns true if we've been told nick is away */
+func isAway(nick string) bool {
+	return st.away[strings.ToLower(nick)]
+}
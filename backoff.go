@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/* Number of too-short connections in a row before backing off */
+const shortcount = 3
+
+/* Longest time to wait before reconnecting */
+const maxbackoff = time.Hour
+
+/* shortSessionWait accounts for the last connection, if it hasn't been
+already, and returns how long to wait before reconnecting if the last few
+connections were killed as soon as they were made.  The wait doubles every
+time, starting at -wait. */
+func shortSessionWait() time.Duration {
+	if !st.insession || 0 == *gc.shortsess {
+		return 0
+	}
+	st.insession = false
+	/* Note whether the server let us stay for a while */
+	l := time.Since(st.connected)
+	if l >= *gc.shortsess {
+		st.nshort = 0
+		return 0
+	}
+	st.nshort++
+	debug("Connection only lasted %v (%v in a row)", l, st.nshort)
+	if st.nshort < shortcount {
+		return 0
+	}
+	/* Double the wait every time, within reason */
+	d := backoff(st.nshort - shortcount + 1)
+	if maxbackoff == d {
+		log.Printf("The server has killed the last %v connections "+
+			"within %v; we're likely banned.  Waiting %v before "+
+			"trying again.", st.nshort, *gc.shortsess, d)
+	} else {
+		verbose("The server has killed the last %v connections "+
+			"within %v, waiting %v before reconnecting",
+			st.nshort, *gc.shortsess, d)
+	}
+	return d
+}
+
+/* backoff returns -wait doubled n times, but no more than maxbackoff */
+func backoff(n int) time.Duration {
+	d := *gc.wait
+	for i := 0; i < n && d < maxbackoff; i++ {
+		d *= 2
+	}
+	if d > maxbackoff {
+		d = maxbackoff
+	}
+	return d
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/* wantedCaps returns the IRCv3 capabilities the flags call for */
+func wantedCaps() []string {
+	c := []string{}
+	if *gc.tags {
+		c = append(c, "message-tags")
+	}
+	if *gc.echomsg || *gc.verifylen {
+		c = append(c, "echo-message")
+	}
+	/* Used to skip replays to away users and note away admins */
+	if *gc.replay || 0 != len(st.admins) {
+		c = append(c, "away-notify")
+	}
+	if *gc.sasl {
+		c = append(c, "sasl")
+	}
+	return c
+}
+
+/* requestCaps forgets the capabilities from the last connection and, if we'd
+like any, asks the server which it has.  Servers which hold registration for
+CAP will wait until we send CAP END; servers which don't support CAP will
+ignore the request.  This is sent after the library's NICK and USER, as
+Connect sends those, so a server which finishes registering us first won't
+wait for SASL. */
+func requestCaps(irc ircConn) error {
+	st.caps = make(map[string]bool)
+	st.capls = make(map[string]bool)
+	st.capreqs = 0
+	st.capend = true
+	if 0 == len(wantedCaps()) {
+		return nil
+	}
+	st.capend = false
+	debug("Asking for the server's capabilities")
+	return irc.PrintfLine("CAP LS 302")
+}
+
+/* handleCap handles a CAP LS, ACK, or NAK for caps.  more is true if the
+server's not done listing its capabilities.  Each capability we'd like and the
+server has is requested separately, so a NAK for one doesn't cost us the
+others. */
+func handleCap(irc ircConn, sub string, more bool, caps string) error {
+	switch sub {
+	case "LS":
+		for _, c := range strings.Fields(caps) {
+			/* 302 lists values after an = */
+			if i := strings.Index(c, "="); -1 != i {
+				c = c[:i]
+			}
+			st.capls[c] = true
+		}
+		if more {
+			return nil
+		}
+		for _, c := range wantedCaps() {
+			if !st.capls[c] {
+				verbose("Capability %v: not offered", c)
+				st.caps[c] = false
+				continue
+			}
+			if err := irc.PrintfLine("CAP REQ :%v", c); nil != err {
+				return errors.New(fmt.Sprintf("unable to request "+
+					"%v: %v", c, err))
+			}
+			st.capreqs++
+		}
+	case "ACK", "NAK":
+		for _, c := range strings.Fields(caps) {
+			/* A leading - means the capability was disabled */
+			on := "ACK" == sub && !strings.HasPrefix(c, "-")
+			c = strings.TrimPrefix(c, "-")
+			verbose("Capability %v: %v", c, on)
+			st.caps[c] = on
+		}
+		if 0 < st.capreqs {
+			st.capreqs--
+		}
+	}
+	/* Start SASL, if we asked for it */
+	if err := handleSASLCap(irc); nil != err {
+		return err
+	}
+	return endCaps(irc)
+}
+
+/* endCaps sends CAP END once every request's been answered and SASL, if
+we're using it, is done.  It's only sent once a connection. */
+func endCaps(irc ircConn) error {
+	if st.capend || 0 != st.capreqs || (st.saslreq && !st.saslok) {
+		return nil
+	}
+	st.capend = true
+	debug("Ending capability negotiation")
+	return irc.PrintfLine("CAP END")
+}
+
+/* stripTags removes IRCv3 message tags from the front of l, so the rest of
+the line can be matched as usual. */
+func stripTags(l string) string {
+	if !strings.HasPrefix(l, "@") {
+		return l
+	}
+	if i := strings.Index(l, " "); -1 != i {
+		return strings.TrimLeft(l[i:], " ")
+	}
+	return ""
+}
+
+/* tagValue escapes v for use as the value of a message tag */
+func tagValue(v string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\:",
+		" ", "\\s",
+		"\r", "\\r",
+		"\n", "\\n",
+	).Replace(v)
+}
+
+/* taggedPrivmsg sends m to target (or the channel, if target is empty) with
+our client tags */
+func taggedPrivmsg(irc ircConn, m, target string) error {
+	if "" == target {
+		target = *gc.channel
+	}
+	if err := irc.PrintfLine("@+ircstatus/host=%v PRIVMSG %v :%v",
+		tagValue(st.hostname), target, m); nil != err {
+		return errors.New(fmt.Sprintf("unable to send tagged "+
+			"message: %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* extraChannel is a channel to which lines are sent besides the first one
+in -channel */
+type extraChannel struct {
+	name    string
+	key     string
+	joined  bool      /* True once we have its names */
+	failed  string    /* Why we couldn't join, if we couldn't */
+	joining time.Time /* When we last sent a JOIN */
+}
+
+/* parseChannels splits -channel, a comma-separated list of channels, each
+optionally followed by :key.  The first channel stays in -channel, with its
+key (if given) in -chanpass.  The rest go in st.extras. */
+func parseChannels() error {
+	for i, c := range strings.Split(*gc.channel, ",") {
+		n, k := strings.TrimSpace(c), ""
+		hasKey := false
+		if j := strings.Index(n, ":"); -1 != j {
+			n, k, hasKey = n[:j], n[j+1:], true
+		}
+		if "" == n {
+			return errors.New(fmt.Sprintf("empty channel name "+
+				"in %q", *gc.channel))
+		}
+		if 0 == i {
+			*gc.channel = n
+			if hasKey {
+				*gc.chanpass = k
+			}
+			continue
+		}
+		st.extras = append(st.extras, &extraChannel{name: n, key: k})
+	}
+	return nil
+}
+
+/* joinExtras joins the channels in st.extras we're not in, once we're
+registered */
+func joinExtras(irc ircConn) error {
+	if st.registered.IsZero() {
+		return nil
+	}
+	for _, c := range st.extras {
+		if c.joined {
+			continue
+		}
+		c.failed = ""
+		c.joining = time.Now()
+		var err error
+		if "" != c.key {
+			err = irc.PrintfLine("JOIN %v %v", c.name, c.key)
+		} else {
+			err = irc.PrintfLine("JOIN %v", c.name)
+		}
+		if nil != err {
+			return errors.New(fmt.Sprintf("unable to join %v: %v",
+				c.name, err))
+		}
+	}
+	return nil
+}
+
+/* forgetChannels forgets which channels we're in, for a new connection */
+func forgetChannels() {
+	st.inchan = false
+	for _, c := range st.extras {
+		c.joined = false
+		c.failed = ""
+		c.joining = time.Time{}
+	}
+}
+
+/* extraChannelNamed returns the channel in st.extras named name, or nil if
+there's none */
+func extraChannelNamed(name string) *extraChannel {
+	for _, c := range st.extras {
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+/* noteJoined notes that we've joined channel, which may or may not be one
+of ours */
+func noteJoined(channel string) {
+	if strings.EqualFold(channel, *gc.channel) {
+		debug("Joined %v", channel)
+		st.inchan = true
+		return
+	}
+	if c := extraChannelNamed(channel); nil != c && !c.joined {
+		verbose("Joined %v", channel)
+		c.joined = true
+	}
+}
+
+/* noteJoinError notes that the server wouldn't let us join channel, for
+reason why.  It returns false if channel isn't one of st.extras. */
+func noteJoinError(channel, why string) bool {
+	c := extraChannelNamed(channel)
+	if nil == c {
+		return false
+	}
+	verbose("Unable to join %v, not sending lines there: %v", channel,
+		why)
+	c.failed = why
+	return true
+}
+
+/* joinedAny returns true if we're in any of our channels, which is enough to
+start sending */
+func joinedAny() bool {
+	return st.inchan || 0 != len(joinedExtras())
+}
+
+/* joinTargets returns the targets for lines, which are the channels we're
+in, with "" for the first channel in -channel */
+func joinTargets() []string {
+	ts := []string{}
+	if st.inchan {
+		ts = append(ts, "")
+	}
+	return append(ts, joinedExtras()...)
+}
+
+/* nextExtraTimeout returns when the first channel in st.extras we've not yet
+heard back about should be given up on, or the zero time if there's none */
+func nextExtraTimeout() time.Time {
+	var t time.Time
+	for _, c := range st.extras {
+		if c.joined || "" != c.failed || c.joining.IsZero() {
+			continue
+		}
+		if d := c.joining.Add(*gc.jtimeout); t.IsZero() || d.Before(t) {
+			t = d
+		}
+	}
+	return t
+}
+
+/* expireExtras gives up on the channels in st.extras we've not heard back
+about for -join-timeout */
+func expireExtras() {
+	for _, c := range st.extras {
+		if c.joined || "" != c.failed || c.joining.IsZero() ||
+			time.Since(c.joining) < *gc.jtimeout {
+			continue
+		}
+		noteJoinError(c.name, "no reply to JOIN")
+	}
+}
+
+/* pendingExtras returns the names of the channels in st.extras we've not yet
+heard back about */
+func pendingExtras() []string {
+	ns := []string{}
+	for _, c := range st.extras {
+		if !c.joined && "" == c.failed {
+			ns = append(ns, c.name)
+		}
+	}
+	return ns
+}
+
+/* joinedExtras returns the names of the channels in st.extras we're in */
+func joinedExtras() []string {
+	ns := []string{}
+	for _, c := range st.extras {
+		if c.joined {
+			ns = append(ns, c.name)
+		}
+	}
+	return ns
+}
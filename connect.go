@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kd5pbo/minimalirc"
+	"net"
+	"time"
+)
+
+/* connect connects i to the server, giving up after -connect-timeout or when
+ctx is cancelled.  If connect gives up but the connection is made anyways,
+it's closed. */
+func connect(ctx context.Context, i *minimalirc.IRC) error {
+	if 0 == *gc.ctimeout {
+		return i.Connect()
+	}
+	/* Unbuffered, so the connection's either taken by us or closed by
+	the goroutine, never neither.  The quit message is rendered here, as
+	st isn't the goroutine's to touch. */
+	c := make(chan error)
+	abandoned := make(chan struct{})
+	qm := quitMessage()
+	go func() {
+		err := i.Connect()
+		select {
+		case c <- err:
+		case <-abandoned:
+			/* Don't leave an unwanted connection lying around */
+			if nil == err {
+				debug("Closing connection made too late")
+				i.Quit(qm)
+			}
+		}
+	}()
+	t := time.NewTimer(*gc.ctimeout)
+	defer t.Stop()
+	select {
+	case err := <-c:
+		return err
+	case <-t.C:
+		close(abandoned)
+		return errors.New(fmt.Sprintf("timed out after %v",
+			*gc.ctimeout))
+	case <-ctx.Done():
+		close(abandoned)
+		return ctx.Err()
+	}
+}
+
+/* familyHost returns the address to give minimalirc for -host.  Unless
+-family is auto, it's the first address of that family -host resolves to, as
+minimalirc dials whatever it's given. */
+func familyHost(ctx context.Context) (string, error) {
+	if "auto" == *gc.family {
+		return *gc.host, nil
+	}
+	as, err := net.DefaultResolver.LookupIP(ctx, "ip"+*gc.family,
+		*gc.host)
+	if nil != err {
+		return "", errors.New(fmt.Sprintf("unable to find an IPv%v "+
+			"address for %v: %v", *gc.family, *gc.host, err))
+	}
+	if 0 == len(as) {
+		return "", errors.New(fmt.Sprintf("%v has no IPv%v address",
+			*gc.host, *gc.family))
+	}
+	verbose("Connecting to %v at %v", *gc.host, as[0])
+	return dialHost(as[0]), nil
+}
+
+/* dialHost returns ip as minimalirc needs it.  It puts the host and port
+together with a colon between them, so IPv6 addresses need brackets. */
+func dialHost(ip net.IP) string {
+	if nil == ip.To4() {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFamilyHost(t *testing.T) {
+	for _, c := range []struct {
+		family string
+		host   string
+		want   string
+	}{
+		{"auto", "irc.example.com", "irc.example.com"},
+		{"4", "127.0.0.1", "127.0.0.1"},
+		{"6", "::1", "[::1]"},
+		{"6", "2001:db8::1", "[2001:db8::1]"},
+	} {
+		setup(t, "-family", c.family, "-host", c.host)
+		got, err := familyHost(context.Background())
+		if nil != err {
+			t.Errorf("-family %v -host %v: %v", c.family, c.host,
+				err)
+		} else if c.want != got {
+			t.Errorf("-family %v -host %v: got %q, want %q",
+				c.family, c.host, got, c.want)
+		}
+	}
+
+	/* An address of the wrong family shouldn't do */
+	setup(t, "-family", "6", "-host", "127.0.0.1")
+	if h, err := familyHost(context.Background()); nil == err {
+		t.Errorf("Got IPv6 address %v for 127.0.0.1", h)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	buildinfo "runtime/debug"
+	"strings"
+	"time"
+)
+
+/* ctcpdelim surrounds CTCP messages */
+const ctcpdelim = "\x01"
+
+/* ctcpgap is the least time between CTCP replies, so a flood of queries
+doesn't get us kicked off the server for flooding */
+const ctcpgap = time.Second
+
+/* parseCTCP returns the command and arguments of the CTCP message in text.
+If text isn't a CTCP message, ok will be false. */
+func parseCTCP(text string) (command, args string, ok bool) {
+	if 2 > len(text) || !strings.HasPrefix(text, ctcpdelim) {
+		return "", "", false
+	}
+	text = strings.TrimSuffix(text[1:], ctcpdelim)
+	parts := strings.SplitN(text, " ", 2)
+	command = strings.ToUpper(parts[0])
+	if 2 == len(parts) {
+		args = parts[1]
+	}
+	return command, args, "" != command
+}
+
+/* ctcpAction frames m as a CTCP ACTION, as sent by /me */
+func ctcpAction(m string) string {
+	return ctcpdelim + "ACTION " + m + ctcpdelim
+}
+
+/* ctcpReply sends a reply to a CTCP command to the nick which sent it.  As
+with all replies, it's a NOTICE, never to the channel. */
+func ctcpReply(irc ircConn, nick, command, args string) error {
+	m := command
+	if "" != args {
+		m += " " + args
+	}
+	return notice(irc, ctcpdelim+m+ctcpdelim, nick)
+}
+
+/* handleCTCP answers VERSION and PING queries from nick.  Other queries, and
+queries too soon after the last one answered, are ignored. */
+func handleCTCP(irc ircConn, nick, command, args string) error {
+	if "VERSION" != command && "PING" != command {
+		debug("Ignoring CTCP %v from %v", command, nick)
+		return nil
+	}
+	if time.Since(st.lastctcp) < ctcpgap {
+		debug("Ignoring CTCP %v from %v, too soon after the last",
+			command, nick)
+		return nil
+	}
+	st.lastctcp = time.Now()
+	debug("Answering CTCP %v from %v", command, nick)
+	if "VERSION" == command {
+		return ctcpReply(irc, nick, command, versionString())
+	}
+	return ctcpReply(irc, nick, command, args)
+}
+
+/* versionString returns ircstatus and, if it was built from a tagged
+module, its version */
+func versionString() string {
+	if bi, ok := buildinfo.ReadBuildInfo(); ok &&
+		"" != bi.Main.Version && "(devel)" != bi.Main.Version {
+		return "ircstatus " + bi.Main.Version
+	}
+	return "ircstatus"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCTCPReplyTarget(t *testing.T) {
+	setup(t, "-channel", "#test")
+	f := newFakeIRC("testnick")
+
+	/* The reply goes to whoever asked, not the channel */
+	if err := handleCTCP(f, "asker", "VERSION", ""); nil != err {
+		t.Fatalf("Error answering VERSION: %v", err)
+	}
+	want := "NOTICE asker :\x01VERSION " + versionString() + "\x01"
+	if 1 != len(f.sent) || want != f.sent[0] {
+		t.Fatalf("Sent %q, not %q", f.sent, want)
+	}
+}
+
+func TestParseCTCP(t *testing.T) {
+	for _, c := range []struct {
+		text    string
+		command string
+		args    string
+		ok      bool
+	}{
+		{"\x01VERSION\x01", "VERSION", "", true},
+		{"\x01ping 12345\x01", "PING", "12345", true},
+		{"\x01PING 1 2 3", "PING", "1 2 3", true},
+		{"\x01ACTION waves\x01", "ACTION", "waves", true},
+		{"VERSION", "", "", false},
+		{"\x01\x01", "", "", false},
+		{"\x01", "", "", false},
+		{"", "", "", false},
+	} {
+		command, args, ok := parseCTCP(c.text)
+		if c.ok != ok || (ok && (c.command != command ||
+			c.args != args)) {
+			t.Errorf("parseCTCP(%q): got %q, %q, %v", c.text,
+				command, args, ok)
+		}
+	}
+}
+
+func TestHandleEventCTCP(t *testing.T) {
+	setup(t, "-channel", "#test")
+	for _, c := range []struct {
+		line string
+		want string
+	}{
+		{":asker!u@h PRIVMSG testnick :\x01VERSION\x01",
+			"NOTICE asker :\x01VERSION " + versionString() +
+				"\x01"},
+		{":asker!u@h PRIVMSG testnick :\x01PING 1234 5678\x01",
+			"NOTICE asker :\x01PING 1234 5678\x01"},
+		{":asker!u@h PRIVMSG #test :\x01PING 1234\x01",
+			"NOTICE asker :\x01PING 1234\x01"},
+		{":asker!u@h PRIVMSG testnick :\x01TIME\x01", ""},
+		{":asker!u@h PRIVMSG testnick :VERSION", ""},
+		{":testnick!u@h PRIVMSG testnick :\x01VERSION\x01", ""},
+	} {
+		f := newFakeIRC("testnick")
+		st.lastctcp = time.Time{}
+		event(t, f, c.line, true)
+		if "" == c.want && 0 != len(f.sent) {
+			t.Errorf("%q: sent %q", c.line, f.sent)
+		} else if "" != c.want && (1 != len(f.sent) ||
+			c.want != f.sent[0]) {
+			t.Errorf("%q: sent %q, not %q", c.line, f.sent,
+				c.want)
+		}
+	}
+
+	/* Too many too fast should be ignored */
+	f := newFakeIRC("testnick")
+	for i := 0; i < 3; i++ {
+		event(t, f, ":asker!u@h PRIVMSG testnick :\x01VERSION\x01",
+			true)
+	}
+	if 1 != len(f.sent) {
+		t.Fatalf("Answered a flood of queries with %q", f.sent)
+	}
+}
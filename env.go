@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"text/template"
+)
+
+/* Flags in which ${VAR} is replaced with the environment variable VAR, unless
+-no-expand is given. */
+var expandable = []string{
+	"host",
+	"nick",
+	"uname",
+	"rname",
+	"idnick",
+	"channel",
+	"chanpass",
+	"qmsg",
+	"pipe",
+	"heartbeat-msg",
+	"mirror-file",
+	"record",
+	"fallback-file",
+	"instance",
+	"footer",
+}
+
+/* Functions available to every template */
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+}
+
+/* expandFlags replaces ${VAR} with the value of the environment variable VAR
+in the flags in expandable.  Unset variables expand to the empty string. */
+func expandFlags() {
+	for _, n := range expandable {
+		f := flag.Lookup(n)
+		if nil == f {
+			debug("No flag %q to expand", n)
+			continue
+		}
+		v := f.Value.String()
+		e := re.EnvVar.ReplaceAllStringFunc(v, func(s string) string {
+			return os.Getenv(re.EnvVar.FindStringSubmatch(s)[1])
+		})
+		if e == v {
+			continue
+		}
+		f.Value.Set(e)
+		debug("Expanded -%v", n)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+/* Exit codes, which are also listed in the README */
+const (
+	exitOK        = 0 /* All went well, or stdin ended */
+	exitError     = 1 /* Error while running */
+	exitConfig    = 2 /* Invalid flags or unreadable config files */
+	exitPassword  = 3 /* Unable to read the password from stdin */
+	exitSaveHelp  = 4 /* Unable to save the help text */
+	exitCancelled = 5 /* Stopped by main, which sets its own code */
+	exitRetries   = 6 /* Too many failed connection attempts */
+
+	/* Caught a signal; the signal number is added */
+	exitSignal = 128
+)
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+/* fakeIRC is an ircConn which records what's sent to it and reads lines from
+a channel the test fills */
+type fakeIRC struct {
+	sent  []string    /* Lines sent, PRIVMSGs included */
+	sl    sync.Mutex  /* Lock for sent, as sends may time out */
+	lines chan string /* Lines from the "server" */
+	errs  chan error  /* Error sent when lines is closed */
+	nick  string      /* What SNick returns */
+	size  int         /* What PrivmsgSize returns */
+	block chan bool   /* If set, sends wait until it's closed */
+	rand  bool        /* Set by SetRandomNumbers */
+}
+
+/* newFakeIRC returns a fakeIRC whose nick is nick */
+func newFakeIRC(nick string) *fakeIRC {
+	return &fakeIRC{
+		lines: make(chan string, 16),
+		errs:  make(chan error, 1),
+		nick:  nick,
+		size:  400,
+	}
+}
+
+/* send records a sent line */
+func (f *fakeIRC) send(l string) error {
+	if nil != f.block {
+		<-f.block
+	}
+	f.sl.Lock()
+	defer f.sl.Unlock()
+	f.sent = append(f.sent, l)
+	return nil
+}
+
+/* sentLine returns true if f sent l */
+func (f *fakeIRC) sentLine(l string) bool {
+	f.sl.Lock()
+	defer f.sl.Unlock()
+	for _, s := range f.sent {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeIRC) Privmsg(msg, target string) error {
+	return f.send(fmt.Sprintf("PRIVMSG %v :%v", target, msg))
+}
+
+func (f *fakeIRC) PrivmsgSize(target string) int {
+	return f.size
+}
+
+func (f *fakeIRC) PrintfLine(s string, a ...interface{}) error {
+	return f.send(fmt.Sprintf(s, a...))
+}
+
+func (f *fakeIRC) Quit(msg string) error {
+	return f.send("QUIT :" + msg)
+}
+
+func (f *fakeIRC) Handshake() error {
+	return f.send("HANDSHAKE")
+}
+
+func (f *fakeIRC) Auth() error {
+	return nil
+}
+
+func (f *fakeIRC) Join() error {
+	return f.send("JOIN " + *gc.channel)
+}
+
+func (f *fakeIRC) SNick() string {
+	return f.nick
+}
+
+func (f *fakeIRC) SetRandomNumbers(on bool) {
+	f.rand = on
+}
+
+func (f *fakeIRC) Lines() <-chan string {
+	return f.lines
+}
+
+func (f *fakeIRC) Errors() <-chan error {
+	return f.errs
+}
+
+/* defineOnce makes sure the flags are only defined once.  Goroutines left
+over from earlier tests may still be reading them. */
+var defineOnce sync.Once
+
+/* setup resets the global state and parses args as the command line.  As
+the flags are only defined once, flag.Visit sees flags given to earlier
+tests as well. */
+func setup(t testing.TB, args ...string) {
+	reflect.ValueOf(&st).Elem().Set(reflect.Zero(reflect.TypeOf(st)))
+	defineOnce.Do(func() {
+		flag.CommandLine = flag.NewFlagSet("ircstatus",
+			flag.ContinueOnError)
+		n := "testnick"
+		gc.nick = &n
+		defineFlags()
+		compileRegexps()
+	})
+	/* Undo the last test's flags */
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.DefValue != f.Value.String() {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	if err := flag.CommandLine.Parse(args); nil != err {
+		t.Fatalf("Unable to parse %q: %v", args, err)
+	}
+	st.nick = *gc.nick
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+/* fallingBack returns true if IRC has been down long enough for lines to go
+to -fallback-file */
+func fallingBack() bool {
+	return "" != *gc.fbfile && !st.down.IsZero() &&
+		time.Since(st.down) >= *gc.fbafter
+}
+
+/* fallbackWrite appends l to -fallback-file */
+func fallbackWrite(l string) error {
+	if err := appendLines(*gc.fbfile, []string{l}); nil != err {
+		return err
+	}
+	debug("Wrote line to %v", *gc.fbfile)
+	st.fbpending = *gc.fbreplay
+	return nil
+}
+
+/* queueFallback queues the next line saved in -fallback-file while IRC was
+down, once the outbox is empty, along with a progress notice if one's due.
+The file's read into st.fbq and emptied when the replay starts, so lines
+written later start a new replay.  Lines are queued one at a time so nothing
+else waits on a big backlog. */
+func queueFallback(irc ircConn) error {
+	if outboxBusy() {
+		return nil
+	}
+	/* Slurp the saved lines */
+	if st.fbpending && 0 == len(st.fbq) {
+		ls, err := readLines(*gc.fbfile)
+		if nil != err {
+			return err
+		}
+		if err := rewriteLines(*gc.fbfile, nil); nil != err {
+			return err
+		}
+		st.fbpending = false
+		st.fbq = ls
+		st.fbn = 0
+		st.fbtotal = len(ls)
+		st.fblast = time.Now()
+		verbose("Replaying %v lines from %v", len(ls), *gc.fbfile)
+	}
+	if 0 == len(st.fbq) {
+		return nil
+	}
+	queueLine(irc, st.fbq[0], true)
+	st.fbq = st.fbq[1:]
+	st.fbn++
+	/* Let the channel know we're still at it */
+	if 0 != len(st.fbq) && replayProgressDue(st.fbn, st.fblast) {
+		ms := lineMessages(irc, fmt.Sprintf(
+			"(replaying backlog: %v/%v)", st.fbn, st.fbtotal,
+		))
+		for i := range ms {
+			ms[i].replay = true
+		}
+		st.outbox = append(st.outbox, ms...)
+		st.fblast = time.Now()
+	}
+	return nil
+}
+
+/* requeueFallback puts the lines not yet replayed back at the start of
+-fallback-file, to be replayed next time IRC's back. */
+func requeueFallback() {
+	if 0 == len(st.fbq) {
+		return
+	}
+	ls, err := readLines(*gc.fbfile)
+	if nil != err {
+		verbose("Unable to read %v: %v", *gc.fbfile, err)
+	}
+	keepUnsent(append(st.fbq, ls...))
+	st.fbq = nil
+	st.fbpending = true
+}
+
+/* readLines returns the lines in the file named fname */
+func readLines(fname string) ([]string, error) {
+	f, err := os.Open(fname)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	ls := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		ls = append(ls, strings.TrimRight(s.Text(), "\r"))
+	}
+	return ls, s.Err()
+}
+
+/* keepUnsent puts ls back in -fallback-file, to be sent next time */
+func keepUnsent(ls []string) {
+	if err := rewriteLines(*gc.fbfile, ls); nil != err {
+		verbose("Unable to save unsent lines to %v: %v", *gc.fbfile,
+			err)
+	}
+}
+
+/* replayDelay returns the time to wait between replayed lines, which is
+-replay-delay if set or -senddelay if not */
+func replayDelay() time.Duration {
+	if 0 < *gc.rpdelay {
+		return *gc.rpdelay
+	}
+	return sendDelay()
+}
+
+/* replayProgressDue returns true if a progress notice should be sent after
+the nth replayed line, the last notice (or the start of the replay) having
+been at last */
+func replayProgressDue(n int, last time.Time) bool {
+	if *gc.rpquiet {
+		return false
+	}
+	if 0 < *gc.rpnth && 0 == n%*gc.rpnth {
+		return true
+	}
+	return 0 < *gc.rpevery && time.Since(last) >= *gc.rpevery
+}
+
+/* appendLines appends ls, each followed by a newline, to the file named
+fname */
+func appendLines(fname string, ls []string) error {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if nil != err {
+		return err
+	}
+	for _, l := range ls {
+		if _, err := fmt.Fprintln(f, l); nil != err {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+/* rewriteLines replaces the contents of the file named fname with ls */
+func rewriteLines(fname string, ls []string) error {
+	if err := os.Truncate(fname, 0); nil != err {
+		return err
+	}
+	return appendLines(fname, ls)
+}
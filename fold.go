@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/* Shared prefixes shorter than this aren't worth folding */
+const minfold = 8
+
+/* Replacement for a folded prefix */
+const foldmark = "\u21b3 "
+
+/* foldPrefix replaces the prefix l shares with the previous line with
+foldmark, if the previous line was part of the same burst.  The prefix is
+only folded up to the last space or closing bracket, to avoid leaving part of
+a word or timestamp. */
+func foldPrefix(l string) string {
+	/* Remember this line for next time */
+	prev, last := st.lastline, st.lastread
+	st.lastline, st.lastread = l, time.Now()
+	if "" == prev || time.Since(last) > burstgap {
+		return l
+	}
+	/* Find the shared bytes */
+	n := 0
+	for n < len(l) && n < len(prev) && l[n] == prev[n] {
+		n++
+	}
+	/* Back off to the end of the last space-or-bracket-terminated bit */
+	n = strings.LastIndexAny(l[:n], " ])>") + 1
+	/* Don't bother if it'd hardly save anything, or leave nothing */
+	if n < minfold || n == len(l) || !utf8.RuneStart(l[n]) {
+		return l
+	}
+	return foldmark + l[n:]
+}
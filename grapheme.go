@@ -0,0 +1,92 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+/* Runes with special meaning in grapheme clusters */
+const (
+	zwj      = '\u200D'     /* Zero-width joiner */
+	riFirst  = '\U0001F1E6' /* First regional indicator (flag letter) */
+	riLast   = '\U0001F1FF' /* Last regional indicator */
+	modFirst = '\U0001F3FB' /* First emoji (skin tone) modifier */
+	modLast  = '\U0001F3FF' /* Last emoji modifier */
+	tagFirst = '\U000E0020' /* First tag character (subdivision flags) */
+	tagLast  = '\U000E007F' /* Last tag character */
+)
+
+/* ArrayOfShortClusters is like ArrayOfShortStrings, but keeps grapheme
+clusters together, not just runes.  Clusters larger than l bytes are replaced
+with a ?. */
+func ArrayOfShortClusters(s string, l int) []string {
+	/* Easy case, string fits */
+	if len(s) <= l {
+		return []string{s}
+	}
+	o := []string{}
+	/* Working string */
+	w := ""
+	for _, c := range graphemeClusters(s) {
+		/* If the cluster is larger than the string size, replace
+		with ? */
+		if len(c) > l {
+			c = "?"
+		}
+		/* If adding the cluster would make the working string too
+		big, save it and start a new one */
+		if len(w)+len(c) > l {
+			o = append(o, w)
+			w = ""
+		}
+		w += c
+	}
+	/* Append the final working string */
+	return append(o, w)
+}
+
+/* graphemeClusters splits s into (approximately) grapheme clusters.  This
+isn't all of UAX #29, but handles combining marks, ZWJ sequences, emoji
+modifiers, tag sequences, and regional indicator pairs, which covers what's
+likely to turn up in status messages. */
+func graphemeClusters(s string) []string {
+	cs := []string{}
+	start := 0    /* Start of the current cluster */
+	var prev rune /* Previous rune */
+	nri := 0      /* Regional indicators in the current cluster */
+	for i, r := range s {
+		if 0 != i && !extendsCluster(prev, r, nri) {
+			cs = append(cs, s[start:i])
+			start = i
+			nri = 0
+		}
+		if riFirst <= r && r <= riLast {
+			nri++
+		}
+		prev = r
+	}
+	if start < len(s) {
+		cs = append(cs, s[start:])
+	}
+	return cs
+}
+
+/* extendsCluster returns true if r continues the cluster which ended with
+prev and contains nri regional indicators. */
+func extendsCluster(prev, r rune, nri int) bool {
+	switch {
+	case utf8.RuneError == r:
+		return false
+	case zwj == prev, zwj == r: /* Joined to whatever's next */
+		return true
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc): /* Marks */
+		return true
+	case modFirst <= r && r <= modLast: /* Skin tones */
+		return true
+	case tagFirst <= r && r <= tagLast: /* Subdivision flags */
+		return true
+	case riFirst <= r && r <= riLast: /* Flags are pairs */
+		return 1 == nri && riFirst <= prev && prev <= riLast
+	}
+	return false
+}
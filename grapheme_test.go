@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGraphemeClusters(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want []string
+	}{
+		{"abc", []string{"a", "b", "c"}},
+		{"e\u0301e\u0301", []string{"e\u0301", "e\u0301"}},
+		{"👍🏽👍", []string{"👍🏽", "👍"}},
+		{"🇺🇸🇬🇧", []string{"🇺🇸", "🇬🇧"}},
+		{"🇺🇸🇬", []string{"🇺🇸", "🇬"}},
+		{"👩\u200d💻x", []string{"👩\u200d💻", "x"}},
+	} {
+		if got := graphemeClusters(c.s); !reflect.DeepEqual(got,
+			c.want) {
+			t.Errorf("graphemeClusters(%q): got %q, want %q",
+				c.s, got, c.want)
+		}
+	}
+}
+
+func TestArrayOfShortClusters(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		l    int
+		want []string
+	}{
+		{"e\u0301e\u0301", 4, []string{"e\u0301", "e\u0301"}},
+		{"e\u0301e\u0301", 6, []string{"e\u0301e\u0301"}},
+		{"ae\u0301b", 2, []string{"a?", "b"}},
+		{"👍🏽👍", 8, []string{"👍🏽", "👍"}},
+		{"👍🏽👍", 7, []string{"?👍"}},
+		{"🇺🇸🇬🇧", 8, []string{"🇺🇸", "🇬🇧"}},
+		{"🇺🇸🇬🇧", 12, []string{"🇺🇸", "🇬🇧"}},
+		{"a🇺🇸", 8, []string{"a", "🇺🇸"}},
+	} {
+		if got := ArrayOfShortClusters(c.s, c.l); !reflect.DeepEqual(
+			got, c.want) {
+			t.Errorf("ArrayOfShortClusters(%q, %v): got %q, "+
+				"want %q", c.s, c.l, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* event feeds l to handleEvent as if from f, and returns what it returns */
+func event(t *testing.T, f *fakeIRC, l string, ready bool) (bool, bool) {
+	f.lines <- l
+	_, newIRC, ready, err := handleEvent(context.Background(), nil, f,
+		ready)
+	if nil != err {
+		t.Fatalf("Error handling %q: %v", l, err)
+	}
+	return newIRC, ready
+}
+
+func TestHandleEventNickInUse(t *testing.T) {
+	setup(t, "-altnicks", "alt1,alt2")
+	st.altnicks = []string{"alt1", "alt2"}
+	f := newFakeIRC("testnick")
+	st.nick = ""
+
+	/* Each 433 should get the next alternate nick */
+	for _, n := range st.altnicks {
+		if newIRC, _ := event(t, f, ":srv 433 * testnick :Nickname "+
+			"is already in use", false); newIRC {
+			t.Fatalf("Reconnecting after 433")
+		}
+		if !f.sentLine("NICK :" + n) {
+			t.Fatalf("Didn't try %v, sent %q", n, f.sent)
+		}
+	}
+
+	/* Once they're gone, the library adds numbers */
+	event(t, f, ":srv 433 * alt2 :Nickname is already in use", false)
+	if !f.rand || !f.sentLine("HANDSHAKE") {
+		t.Fatalf("Didn't retry with random numbers, sent %q", f.sent)
+	}
+}
+
+func TestHandleEventNickInUseNickLen(t *testing.T) {
+	setup(t, "-nick", "averylongnick")
+	f := newFakeIRC("averylongnick")
+	st.nick = ""
+	st.nicklen = 9
+
+	/* The numbers should replace the end of the nick */
+	event(t, f, ":srv 433 * averylongnick :Nickname is already in use",
+		false)
+	if 0 == len(f.sent) || !strings.HasPrefix(f.sent[0], "NICK :") {
+		t.Fatalf("Nick not retried, sent %q", f.sent)
+	}
+	n := strings.TrimPrefix(f.sent[0], "NICK :")
+	if 9 < len(n) || !strings.HasPrefix(n, "avery") ||
+		"averylong" == n {
+		t.Fatalf("Bad nick retry %q", n)
+	}
+}
+
+func TestHandleEventJoined(t *testing.T) {
+	setup(t, "-channel", "#test")
+	f := newFakeIRC("testnick")
+
+	/* Not ready until the names are done */
+	if _, ready := event(t, f, ":srv 353 testnick = #test :testnick "+
+		"@someone", false); ready {
+		t.Fatalf("Ready before end of names")
+	}
+	if _, ready := event(t, f, ":srv 366 testnick #test :End of "+
+		"/NAMES list.", false); !ready {
+		t.Fatalf("Not ready after end of names")
+	}
+	if !st.inchan {
+		t.Fatalf("Not in channel after end of names")
+	}
+
+	/* Names for someone else's channel shouldn't count */
+	setup(t, "-channel", "#test")
+	if _, ready := event(t, f, ":srv 366 testnick #other :End of "+
+		"/NAMES list.", false); ready {
+		t.Fatalf("Ready after joining the wrong channel")
+	}
+}
+
+func TestHandleEventSelfNick(t *testing.T) {
+	setup(t)
+	f := newFakeIRC("testnick")
+
+	/* Someone else changing nick shouldn't change ours */
+	event(t, f, ":other!u@h NICK :another", true)
+	if "testnick" != st.nick {
+		t.Fatalf("Nick changed to %v by someone else", st.nick)
+	}
+
+	/* A forced rename should */
+	event(t, f, ":TestNick!u@h NICK :Guest123", true)
+	if "Guest123" != st.nick {
+		t.Fatalf("Nick is %v, not Guest123", st.nick)
+	}
+	if !isUs(f, "guest123") || isUs(f, "testnick") {
+		t.Fatalf("Still think we're %v", f.nick)
+	}
+}
+
+func TestHandleEventSelfPrivmsg(t *testing.T) {
+	setup(t, "-channel", "#test")
+	st.admins = []string{"*!*@*"}
+	f := newFakeIRC("testnick")
+
+	/* Our own messages, echoed back, shouldn't be commands */
+	if newIRC, _ := event(t, f, ":TestNick!u@h PRIVMSG #test "+
+		":!reconnect", true); newIRC {
+		t.Fatalf("Reconnected after our own !reconnect")
+	}
+	if 0 != len(f.sent) {
+		t.Fatalf("Answered our own message with %q", f.sent)
+	}
+
+	/* But someone else's should */
+	if newIRC, _ := event(t, f, ":admin!u@h PRIVMSG #test :!reconnect",
+		true); !newIRC {
+		t.Fatalf("Didn't reconnect after an admin's !reconnect")
+	}
+}
+
+func TestHandleEventNamesInterleaved(t *testing.T) {
+	setup(t, "-channel", "#a,#b,#c")
+	if err := parseChannels(); nil != err {
+		t.Fatalf("Unable to parse channels: %v", err)
+	}
+	f := newFakeIRC("testnick")
+
+	ready := false
+	for _, c := range []struct {
+		line    string
+		ready   bool
+		targets []string
+	}{
+		{":srv 353 testnick = #b :@testnick other", false, []string{}},
+		{":srv 353 testnick = #a :+testnick @other", false,
+			[]string{}},
+		{":srv 353 testnick = #b :more", false, []string{}},
+		{":srv 366 testnick #b :End of /NAMES list.", true,
+			[]string{"#b"}},
+		{":srv 353 testnick = #c :testnick", true, []string{"#b"}},
+		{":srv 366 testnick #other :End of /NAMES list.", true,
+			[]string{"#b"}},
+		{":srv 366 testnick #a :End of /NAMES list.", true,
+			[]string{"", "#b"}},
+		{":srv 366 testnick #C :End of /NAMES list.", true,
+			[]string{"", "#b", "#c"}},
+	} {
+		_, ready = event(t, f, c.line, ready)
+		if c.ready != ready {
+			t.Fatalf("After %q, ready is %v", c.line, ready)
+		}
+		if got := joinTargets(); !reflect.DeepEqual(got, c.targets) {
+			t.Fatalf("After %q, sending to %q, not %q", c.line,
+				got, c.targets)
+		}
+	}
+
+	/* Only the first channel's names say if we're opped */
+	if st.opped || !st.voiced {
+		t.Fatalf("Opped: %v, voiced: %v", st.opped, st.voiced)
+	}
+}
+
+func TestHandleEventConnectTimeout(t *testing.T) {
+	setup(t, "-connect-timeout", "100ms", "-join-timeout", "0",
+		"-wait", "1m")
+	f := newFakeIRC("testnick")
+
+	/* A server which accepts us but never gets as far as the channel
+	should be given up on, with the usual wait before trying again */
+	st.connected = time.Now()
+	st.registered = time.Now()
+	start := time.Now()
+	_, newIRC, _, err := handleEvent(context.Background(), nil, f, false)
+	if nil != err {
+		t.Fatalf("Error waiting for the server: %v", err)
+	}
+	if !newIRC {
+		t.Fatalf("Didn't give up on a stalled server")
+	}
+	if d := time.Since(start); 100*time.Millisecond > d ||
+		time.Second < d {
+		t.Fatalf("Gave up after %v", d)
+	}
+	if !f.sentLine("QUIT :" + quitMessage()) {
+		t.Fatalf("Didn't close the connection, sent %q", f.sent)
+	}
+	if d := time.Until(st.redial); 50*time.Second > d {
+		t.Fatalf("Trying again in %v", d)
+	}
+
+	/* Getting into the channel in time should stop the timeout */
+	setup(t, "-connect-timeout", "100ms", "-join-timeout", "0",
+		"-channel", "#test")
+	st.connected = time.Now()
+	if _, ready := event(t, f, ":srv 366 testnick #test :End of "+
+		"/NAMES list.", false); !ready {
+		t.Fatalf("Not ready after joining")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if newIRC, _ := event(t, f, ":srv PONG :x", true); newIRC {
+		t.Fatalf("Gave up on a server after joining")
+	}
+}
+
+func TestHandleEventHandshakeDelay(t *testing.T) {
+	setup(t, "-handshake-delay", "1h", "-channel", "#test", "-chanpass",
+		"")
+	f := newFakeIRC("testnick")
+
+	/* Registering shouldn't hold up the loop until it's time to join */
+	start := time.Now()
+	event(t, f, ":srv 001 testnick :Welcome", false)
+	if d := time.Since(start); time.Second < d {
+		t.Fatalf("Handling 001 took %v", d)
+	}
+	if 0 != len(f.sent) || st.joinat.IsZero() {
+		t.Fatalf("Not waiting to join, sent %q", f.sent)
+	}
+	st.joinat = time.Now()
+	handleEvent(context.Background(), nil, f, false)
+	if !f.sentLine("JOIN #test") || !st.joinat.IsZero() {
+		t.Fatalf("Didn't join when it was time, sent %q", f.sent)
+	}
+
+	/* Nor should joining, though nothing's sent until it's time */
+	_, ready := event(t, f, ":srv 366 testnick #test :End of /NAMES "+
+		"list.", false)
+	if !ready {
+		t.Fatalf("Not ready after joining")
+	}
+	if st.cssent || time.Until(st.nextsend) < 50*time.Minute {
+		t.Fatalf("Not waiting to send")
+	}
+	st.csat = time.Now()
+	handleEvent(context.Background(), nil, f, true)
+	if !st.cssent || !st.csat.IsZero() {
+		t.Fatalf("Didn't talk to ChanServ when it was time")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+)
+
+/* nextHeartbeat returns the time at which the next heartbeat is due, which is
+-heartbeat after the last line, heartbeat, or connection, whichever was
+latest. */
+func nextHeartbeat() time.Time {
+	t := st.connected
+	if st.lastsent.After(t) {
+		t = st.lastsent
+	}
+	if st.lastbeat.After(t) {
+		t = st.lastbeat
+	}
+	return t.Add(*gc.beat)
+}
+
+/* heartbeat sends the heartbeat message as requested by -heartbeat-as.  As a
+line, it's queued in the outbox with everything else. */
+func heartbeat(irc ircConn) error {
+	debug("Sending heartbeat as %v", *gc.beatas)
+	st.lastbeat = time.Now()
+	switch *gc.beatas {
+	case "topic":
+		return withWriteTimeout(func() error {
+			return irc.PrintfLine("TOPIC %v :%v", *gc.channel,
+				*gc.beatmsg)
+		})
+	case "away":
+		return withWriteTimeout(func() error {
+			return irc.PrintfLine("AWAY :%v", *gc.beatmsg)
+		})
+	default:
+		/* Sent like a line, but not mirrored or counted as one */
+		ms := lineMessages(irc, *gc.beatmsg)
+		for i := range ms {
+			ms[i].mirror = false
+		}
+		st.outbox = append(st.outbox, ms...)
+		return nil
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestHeartbeatLine(t *testing.T) {
+	setup(t, "-action", "-channel", "#a,#b", "-heartbeat-msg", "alive")
+	if err := parseChannels(); nil != err {
+		t.Fatalf("Unable to parse channels: %v", err)
+	}
+	noteJoined("#b")
+	var mirrored []string
+	st.mirrors = []Sink{testSink{&mirrored}}
+	f := newFakeIRC("testnick")
+
+	/* The heartbeat goes where lines go, the way lines go */
+	if err := heartbeat(f); nil != err {
+		t.Fatalf("Error sending heartbeat: %v", err)
+	}
+	if 0 != len(f.sent) {
+		t.Fatalf("Heartbeat skipped the outbox: %q", f.sent)
+	}
+	for 0 != len(st.outbox) {
+		if err := sendQueued(f); nil != err {
+			t.Fatalf("Error sending heartbeat: %v", err)
+		}
+	}
+	if want := "PRIVMSG #b :\x01ACTION alive\x01"; 1 != len(f.sent) ||
+		want != f.sent[0] {
+		t.Fatalf("Sent %q, not %q", f.sent, want)
+	}
+	if 0 != len(mirrored) || 0 != st.lines {
+		t.Fatalf("Heartbeat mirrored (%q) or counted as a line",
+			mirrored)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/* maxhistory is the number of connection errors and reconnects remembered
+for !history */
+const maxhistory = 20
+
+/* historyEvent is a connection error or reconnect, for !history */
+type historyEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+}
+
+/* noteEvent remembers an error or reconnect for !history, forgetting the
+oldest if there are too many */
+func noteEvent(f string, a ...interface{}) {
+	st.history = append(st.history, historyEvent{
+		Time:  time.Now(),
+		Event: fmt.Sprintf(f, a...),
+	})
+	if maxhistory < len(st.history) {
+		st.history = st.history[len(st.history)-maxhistory:]
+	}
+}
+
+/* history returns the last n (or all, if n is 0) events as JSON, one per
+line, oldest first */
+func history(n int) []string {
+	h := st.history
+	if 0 < n && n < len(h) {
+		h = h[len(h)-n:]
+	}
+	ls := make([]string, 0, len(h))
+	for _, e := range h {
+		b, err := json.Marshal(e)
+		if nil != err {
+			debug("Unable to marshal %#v: %v", e, err)
+			continue
+		}
+		ls = append(ls, string(b))
+	}
+	return ls
+}
+
+/* historyCount parses the number of events asked for with !history.  If
+none are asked for, a handful are returned. */
+func historyCount(args []string) int {
+	if 0 == len(args) {
+		return 5
+	}
+	n, err := strconv.Atoi(args[0])
+	if nil != err || 0 > n {
+		return 5
+	}
+	return n
+}
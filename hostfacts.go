@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+)
+
+/* Realnames longer than this may be refused or truncated by the server */
+const maxrname = 50
+
+/* hostFacts holds a few facts about the local host for templates.  Any facts
+which can't be gathered are left empty. */
+type hostFacts struct {
+	Hostname string        /* Hostname */
+	Kernel   string        /* Kernel name and release */
+	Uptime   time.Duration /* Time since boot */
+	Load     string        /* Load averages */
+}
+
+/* gatherHostFacts gathers what it can about the local host.  The OS-specific
+bits are in hostfacts_*.go. */
+func gatherHostFacts() hostFacts {
+	h := hostFacts{}
+	h.Hostname, _ = os.Hostname()
+	h.Kernel = kernel()
+	h.Uptime = uptime() / time.Second * time.Second
+	h.Load = loadAverage()
+	return h
+}
+
+/* sysinfo returns a one-line summary of the local host */
+func sysinfo() string {
+	h := gatherHostFacts()
+	s := h.Hostname
+	if 0 != h.Uptime {
+		s += fmt.Sprintf(", up %v", h.Uptime)
+	}
+	if "" != h.Load {
+		s += ", load " + h.Load
+	}
+	if "" != h.Kernel {
+		s += ", " + h.Kernel
+	}
+	return s
+}
+
+/* realName renders the -rname-template with the current host facts, if it was
+given.  If it wasn't or can't be rendered, -rname is returned. */
+func realName() string {
+	if nil == st.rname {
+		return *gc.rname
+	}
+	b := &bytes.Buffer{}
+	if err := st.rname.Execute(b, gatherHostFacts()); nil != err {
+		verbose("Unable to render real name: %v", err)
+		return *gc.rname
+	}
+	if "" == b.String() {
+		return *gc.rname
+	}
+	/* Don't make it too long, keeping runes together */
+	r := ArrayOfShortStrings(b.String(), maxrname)[0]
+	debug("Real name: %v", r)
+	return r
+}
+
+/* parseRealName parses -rname-template, if given */
+func parseRealName() (*template.Template, error) {
+	if "" == *gc.rnamet {
+		return nil, nil
+	}
+	return template.New("rname").Funcs(templateFuncs).Parse(
+		*gc.rnamet)
+}
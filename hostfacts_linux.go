@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* kernel returns the kernel release from /proc */
+func kernel() string {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if nil != err {
+		debug("Unable to read kernel release: %v", err)
+		return ""
+	}
+	return "Linux " + strings.TrimSpace(string(b))
+}
+
+/* uptime returns the time since boot from /proc */
+func uptime() time.Duration {
+	b, err := ioutil.ReadFile("/proc/uptime")
+	if nil != err {
+		debug("Unable to read uptime: %v", err)
+		return 0
+	}
+	f := strings.Fields(string(b))
+	if 0 == len(f) {
+		return 0
+	}
+	s, err := strconv.ParseFloat(f[0], 64)
+	if nil != err {
+		debug("Unable to parse uptime %q: %v", f[0], err)
+		return 0
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+/* loadAverage returns the 1, 5, and 15 minute load averages from /proc */
+func loadAverage() string {
+	b, err := ioutil.ReadFile("/proc/loadavg")
+	if nil != err {
+		debug("Unable to read load average: %v", err)
+		return ""
+	}
+	f := strings.Fields(string(b))
+	if len(f) < 3 {
+		return ""
+	}
+	return strings.Join(f[:3], " ")
+}
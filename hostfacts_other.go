@@ -0,0 +1,48 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* kernel returns the kernel name and release from uname */
+func kernel() string {
+	return command("uname", "-sr")
+}
+
+/* uptime works out the time since boot from the kern.boottime sysctl */
+func uptime() time.Duration {
+	/* Looks like { sec = 1416787200, usec = 0 } ... */
+	m := regexp.MustCompile(`sec = (\d+)`).FindStringSubmatch(
+		command("sysctl", "-n", "kern.boottime"))
+	if nil == m {
+		return 0
+	}
+	s, err := strconv.ParseInt(m[1], 10, 64)
+	if nil != err {
+		return 0
+	}
+	return time.Since(time.Unix(s, 0))
+}
+
+/* loadAverage returns the load averages from the vm.loadavg sysctl */
+func loadAverage() string {
+	return strings.Trim(command("sysctl", "-n", "vm.loadavg"), "{ }")
+}
+
+/* command runs name with args and returns its trimmed output, or the empty
+string on error. */
+func command(name string, args ...string) string {
+	o, err := exec.Command(name, args...).Output()
+	if nil != err {
+		debug("Unable to run %v: %v", name, err)
+		return ""
+	}
+	return strings.TrimSpace(string(o))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* Files which might hold a machine ID */
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+/* Name of the file in the home directory in which a random ID is kept */
+const hostidfile = ".ircstatus-id"
+
+/* hostlessNick returns a nick to use when the hostname can't be had, made
+unique with an ID from how, which is one of the values allowed by
+-hostless-id. */
+func hostlessNick(how string) (string, error) {
+	var id string
+	switch how {
+	case "none":
+		return defaultnick, nil
+	case "machine-id":
+		id = machineID()
+		if "" != id {
+			break
+		}
+		debug("No machine ID, using a random ID")
+		fallthrough
+	case "random":
+		var err error
+		if id, err = randomID(); nil != err {
+			return "", err
+		}
+	default:
+		return "", errors.New(fmt.Sprintf("unknown -hostless-id %q",
+			how))
+	}
+	/* Just enough to tell hosts apart */
+	f := fnv.New32a()
+	f.Write([]byte(id))
+	return fitNickTo(defaultnick, fmt.Sprintf("-%04x",
+		f.Sum32()&0xFFFF), nicklen), nil
+}
+
+/* machineID returns the local machine's ID, or the empty string if it
+hasn't got one */
+func machineID() string {
+	for _, fn := range machineIDFiles {
+		b, err := ioutil.ReadFile(fn)
+		if nil != err {
+			continue
+		}
+		if id := strings.TrimSpace(string(b)); "" != id {
+			return id
+		}
+	}
+	return ""
+}
+
+/* randomID returns a random ID, which is kept in a file in the home directory
+so it's the same next time.  If the file can't be written, the ID will be
+different next time. */
+func randomID() (string, error) {
+	fn := filepath.Join(os.Getenv("HOME"), hostidfile)
+	if b, err := ioutil.ReadFile(fn); nil == err {
+		if id := strings.TrimSpace(string(b)); "" != id {
+			return id, nil
+		}
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); nil != err {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	if err := ioutil.WriteFile(fn, []byte(id+"\n"), 0600); nil != err {
+		verbose("Unable to save host ID to %v: %v", fn, err)
+	}
+	return id, nil
+}
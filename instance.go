@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"text/template"
+)
+
+/* instancePrefix renders -instance into the prefix for each line, or returns
+the empty string if there's no -instance. */
+func instancePrefix() (string, error) {
+	if "" == *gc.instance {
+		return "", nil
+	}
+	t, err := template.New("instance").Funcs(templateFuncs).Parse(
+		*gc.instance)
+	if nil != err {
+		return "", err
+	}
+	h, _ := os.Hostname()
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, struct {
+		PID      int
+		Hostname string
+	}{os.Getpid(), h}); nil != err {
+		return "", err
+	}
+	return "[" + b.String() + "] ", nil
+}
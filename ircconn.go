@@ -0,0 +1,43 @@
+package main
+
+import "github.com/kd5pbo/minimalirc"
+
+/* ircConn is what handleEvent and friends need from a connection to an IRC
+server.  It's satisfied by mircConn, but makes it possible to use a fake
+server instead. */
+type ircConn interface {
+	Privmsg(msg, target string) error            /* Send to a channel/nick */
+	PrivmsgSize(target string) int               /* Longest Privmsg */
+	PrintfLine(f string, a ...interface{}) error /* Send a raw line */
+	Quit(msg string) error                       /* Say goodbye */
+	Handshake() error                            /* Register, auth, join */
+	Auth() error                                 /* Auth to services */
+	Join() error                                 /* Join the channel */
+	SNick() string                               /* Server's idea of nick */
+	SetRandomNumbers(on bool)                    /* Numbers after nick */
+	Lines() <-chan string                        /* Lines from the server */
+	Errors() <-chan error                        /* Error after Lines */
+}
+
+/* mircConn is an ircConn backed by a minimalirc.IRC */
+type mircConn struct {
+	*minimalirc.IRC
+}
+
+/* SetRandomNumbers sets whether random numbers will be appended to the nick
+on the next handshake */
+func (m mircConn) SetRandomNumbers(on bool) {
+	m.RandomNumbers = on
+}
+
+/* Lines returns the channel on which lines from the server are sent.  It is
+closed when the connection dies. */
+func (m mircConn) Lines() <-chan string {
+	return m.C
+}
+
+/* Errors returns the channel on which the error which killed the connection
+is sent. */
+func (m mircConn) Errors() <-chan error {
+	return m.E
+}
@@ -29,6 +29,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -36,52 +37,308 @@ import (
 	"io"
 	"log"
 	"math"
+	"math/rand"
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 /* Defaults */
 const defaultnick = "ircstatus"
 
+/* How long to wait for everything to stop after an interrupt */
+const shutdownwait = 5 * time.Second
+
+/* Lines further apart than this aren't part of the same burst */
+const burstgap = 5 * time.Second
+
 /* Global config */
 var gc struct {
 	/* Flags */
 	host      *string        /* IRC server hostname */
 	port      *uint          /* IRC server port */
+	family    *string        /* Address family to use, 4, 6, or auto */
 	ssl       *bool          /* Connect with SSL/TLS */
 	sslname   *string        /* Hostname on cert */
 	nick      *string        /* IRC nick to use */
+	nickfrom  *string        /* How to derive the nick from the hostname */
+	hostid    *string        /* How to make the nick unique sans hostname */
 	nums      *bool          /* Append random numbers to nick */
+	altnicks  *string        /* Comma-separated nicks to try on collision */
 	uname     *string        /* Username to pass to IRC server */
 	rname     *string        /* Real name to pass to IRC server */
+	rnamet    *string        /* Template for the real name */
 	idnick    *string        /* Nick to use to auth to NickServ */
 	idpass    *string        /* Password to use to auth to Nickserv */
+	idpfile   *string        /* File from which to read idpass */
+	sasl      *bool          /* Auth with SASL PLAIN */
+	regain    *bool          /* GHOST whatever has our nick */
 	channel   *string        /* Channel to join */
 	chanpass  *string        /* Channel password */
+	cpfile    *string        /* File from which to read channel password */
 	qmsg      *string        /* IRC quit message */
 	pipe      *string        /* FIFO for reading */
 	flush     *bool          /* Flush pipe before reading */
+	ftimeout  *time.Duration /* Time to wait for the pipe to flush */
+	maxline   *int           /* Longest line to read from the pipe */
 	rmpipe    *bool          /* Remove pipe after exit */
 	wait      *time.Duration /* Time to wait between reconnects */
+	retries   *int           /* Failed connects before giving up */
 	senddelay *time.Duration /* Time between sent lines */
+	jitter    *time.Duration /* Maximum random change to senddelay */
+	rate      *int           /* Most messages sent per minute */
+	hsdelay   *time.Duration /* Pause after registering and joining */
+	fold      *bool          /* Fold common prefixes in bursts */
 	verbose   *bool          /* Verbose output */
 	debug     *bool          /* Debug output */
 	rxproto   *bool          /* Print received received IRC messages */
 	txlines   *bool          /* Print lines sent to IRC server */
 	timeout   *time.Duration /* IRC timeout */
+	wtimeout  *time.Duration /* Timeout for sending to the IRC server */
+	ctimeout  *time.Duration /* Timeout for connecting and joining */
+	probeint  *time.Duration /* How often to probe the channel */
+	probewait *time.Duration /* Time to wait for a probe reply */
+	tags      *bool          /* Tag messages with the hostname */
+	beat      *time.Duration /* Heartbeat interval */
+	beatmsg   *string        /* Heartbeat message */
+	beatas    *string        /* How to send the heartbeat */
+	jtimeout  *time.Duration /* Time to wait for a join after 001 */
+	rejoin    *time.Duration /* Time to wait to rejoin after a kick */
+	persjoin  *bool          /* Retry JOINs the server refuses */
+	replay    *bool          /* Replay recent lines to joiners */
+	nreplay   *int           /* Number of recent lines to replay */
+	mfile     *string        /* File to which to mirror sent lines */
+	record    *string        /* File to which to record the channel */
+	signkey   *string        /* Key with which to sign lines */
+	instance  *string        /* Instance ID with which to prefix lines */
+	resumegap *time.Duration /* Gap after which to note input resumed */
+	resumemsg *string        /* Note that input resumed */
+	sendfails *int           /* Send failures before reconnecting */
+	sfwindow  *time.Duration /* Window in which to count sendfails */
+	transform *string        /* Transforms to apply to lines, in order */
+	tsprefix  *string        /* Layout of the time before each line */
+	hostpfx   *bool          /* Put the hostname before each message */
+	action    *bool          /* Send lines as CTCP ACTIONs (/me) */
+	footer    *string        /* Footer to add to some lines */
+	footernth *int           /* How often to add the footer */
+	recmax    *int64         /* Size at which to rotate -record */
+	murl      *string        /* URL to which to mirror sent lines */
+	stdout    *bool          /* Mirror sent lines to stdout */
+	stdoutmrk *string        /* Marker before lines sent to stdout */
+	fbfile    *string        /* File for lines while IRC is down */
+	fbafter   *time.Duration /* How long IRC must be down to use fbfile */
+	fbreplay  *bool          /* Replay fbfile when IRC is back */
+	rpdelay   *time.Duration /* Time between replayed lines */
+	rpnth     *int           /* Replayed lines between progress notices */
+	rpevery   *time.Duration /* Time between progress notices */
+	rpquiet   *bool          /* Don't send replay progress notices */
+	clusters  *bool          /* Split on grapheme cluster boundaries */
+	wrap      *string        /* Where to split long lines */
+	seq       *bool          /* Number lines */
+	seqreset  *bool          /* Restart numbering on reconnect */
+	pasteover *int           /* Paste lines needing more messages */
+	pasteurl  *string        /* Paste service URL */
+	pastefld  *string        /* Paste service form field */
+	umodes    *string        /* User modes to set after registering */
+	admins    *string        /* Masks of users allowed admin commands */
+	shortsess *time.Duration /* Connections shorter than this are suspect */
+	sysinfo   *bool          /* Send system info after joining */
+	echomsg   *bool          /* Request the echo-message capability */
+	verifylen *bool          /* Warn if sent messages are truncated */
+	stagger   *time.Duration /* Most time to wait before first joining */
+	nscmd     *string        /* Template for identifying to NickServ */
+	cscmd     *string        /* Template for ChanServ after joining */
+	csop      *bool          /* Ask ChanServ for ops after joining */
+	csvoice   *bool          /* Ask ChanServ for voice after joining */
+	csmcmd    *string        /* Template to ask ChanServ for ops/voice */
+	register  *bool          /* Register the nick if it's not */
+	regemail  *string        /* Email address with which to register */
+	regcmd    *string        /* Template to register the nick */
+	muteline  *string        /* Input line which toggles muting */
+	mutedrop  *bool          /* Drop, not buffer, lines while muted */
+	mbufbytes *int           /* Most bytes to buffer while muted */
+	skipblank *bool          /* Don't send blank lines */
+	pinsecure *bool          /* Use pipes owned by other users */
+	nolock    *bool          /* Don't lock the pipe */
+	noexpand  *bool          /* Don't expand ${VAR} in flags */
 	savehelp  *string        /* Filename to which to save help text */
+	shformat  *string        /* Format of the saved help text */
 }
 
 /* Global regular expressions */
-const reChannelJoined = `(:\S+ )?353 .*\S+ `
+const reEnvVar = `\$\{([A-Za-z_][A-Za-z0-9_]*)\}`
+const reNames = `^(:\S+ )?353 \S+ [=*@] (\S+) :?(.*)$`
+const reEndOfNames = `^(:\S+ )?366 \S+ (\S+) `
 const reNickInUse = `(:\S+ )?433 .*\S+ :Nickname is already in use\.?`
+const reNickError = `^(:\S+ )?(432|433|435|436|437) `
+const reCap = `^(:\S+ )?CAP \S+ (LS|ACK|NAK)( \*)? :?(.*)$`
+const reWelcome = `^(:\S+ )?001 (\S+) `
+const reNick = `^:([^!\s]+)!\S+ NICK :?(\S+)`
+const reUmodeUnknown = `^(:\S+ )?501 `
+const rePrivmsg = `^:(([^!\s]+)!\S+) PRIVMSG (\S+) :(.*)$`
+const reJoin = `^:([^!\s]+)!\S+ JOIN :?(\S+)`
+const reISupport = `^(:\S+ )?005 \S+ (.*)$`
+const reNickServ = `^:NickServ!\S+ NOTICE \S+ :(.*)$`
+const reAway = `^:([^!\s]+)!\S+ AWAY( :?(.*))?$`
+const reProbeReply = `^(:\S+ )?(331|332|442) \S+ (\S+)`
+const reMode = `^:\S+ MODE (\S+) (\S+)(.*)$`
+const reAuthenticate = `^(:\S+ )?AUTHENTICATE :?\+$`
+const reSASL = `^(:\S+ )?(90[2-7]) \S+ :?(.*)$`
+const reKick = `^:([^!\s]+)!\S+ KICK (\S+) (\S+)( :?(.*))?$`
+const reJoinError = `^(:\S+ )?(403|405|471|473|474|475|477) \S+ (\S+)`
 
 var re struct {
-	ChannelJoined *regexp.Regexp
-	NickInUse     *regexp.Regexp
+	Names        *regexp.Regexp
+	EndOfNames   *regexp.Regexp
+	NickInUse    *regexp.Regexp
+	NickError    *regexp.Regexp
+	Cap          *regexp.Regexp
+	Welcome      *regexp.Regexp
+	JoinError    *regexp.Regexp
+	Join         *regexp.Regexp
+	Nick         *regexp.Regexp
+	UmodeUnknown *regexp.Regexp
+	Privmsg      *regexp.Regexp
+	ISupport     *regexp.Regexp
+	Mode         *regexp.Regexp
+	NickServ     *regexp.Regexp
+	Away         *regexp.Regexp
+	ProbeReply   *regexp.Regexp
+	EnvVar       *regexp.Regexp
+	Authenticate *regexp.Regexp
+	SASL         *regexp.Regexp
+	Kick         *regexp.Regexp
+}
+
+/* Global runtime state */
+var st struct {
+	altnicks []string /* Alternate nicks, from -altnicks */
+	nalt     int      /* Number of alternate nicks tried this connection */
+
+	qmsg       *template.Template /* Quit message template */
+	connected  time.Time          /* Time the current connection was made */
+	lines      uint64             /* Number of lines sent */
+	reconnects uint64             /* Number of reconnects */
+	connfails  int                /* Failed connects in a row */
+
+	lastline string    /* Last line read from the pipe, unfolded */
+	lastread time.Time /* Time the last line was read from the pipe */
+
+	hostname string          /* Local hostname */
+	caps     map[string]bool /* IRCv3 capabilities the server ACK'd */
+	capls    map[string]bool /* IRCv3 capabilities the server has */
+	capreqs  int             /* CAP REQs not yet ACK'd or NAK'd */
+	capend   bool            /* True once CAP END's been sent */
+	saslreq  bool            /* True once AUTHENTICATE's been sent */
+	saslok   bool            /* True once SASL has succeeded */
+
+	rname *template.Template /* Real name template */
+
+	lastsent time.Time /* Time the last line was sent */
+	lastbeat time.Time /* Time the last heartbeat was sent */
+	lastctcp time.Time /* Time the last CTCP query was answered */
+
+	registered time.Time /* Time the server welcomed us (001) */
+	joinat     time.Time /* Time to join, after -handshake-delay */
+	joinerr    string    /* Why the server wouldn't let us join */
+	inchan     bool      /* True once we're in the channel */
+
+	rejoinat time.Time /* Time to rejoin, after a kick or refusal */
+	rejoined time.Time /* Time we last rejoined */
+	lastkick time.Time /* Time we were last kicked */
+	nkicks   int       /* Kicks in a row within kickwindow */
+
+	extras []*extraChannel /* Channels other than the first in -channel */
+
+	recent     []string             /* Recently sent lines, for replay */
+	replayed   map[string]time.Time /* Last replay time, by nick */
+	lastreplay time.Time            /* Time of the last replay */
+
+	mirrors []Sink /* Non-IRC places to send lines */
+
+	nick string /* Our current nick, as the server sees it */
+
+	down      time.Time /* Time IRC went down */
+	fbpending bool      /* True if there's lines in the fallback file */
+	fbq       []string  /* Lines from the fallback file to replay */
+	fbn       int       /* Lines replayed from the fallback file */
+	fbtotal   int       /* Lines in the fallback file when replay began */
+	fblast    time.Time /* Time of the last replay progress notice */
+	redial    time.Time /* Time to next try to connect */
+	repipe    time.Time /* Time to next try to open the pipe */
+
+	maint  chan os.Signal /* SIGUSR2s, to toggle maintenance */
+	hup    chan os.Signal /* SIGHUPs, to reopen the pipe */
+	paused bool           /* True during maintenance */
+
+	seq uint64 /* Number of the last line numbered by -seq */
+
+	started time.Time /* Time the program started */
+	admins  []string  /* nick!user@host masks allowed admin commands */
+
+	insession bool /* True if a connection hasn't been accounted for */
+	nshort    int  /* Consecutive too-short connections */
+
+	sysinfoSent bool /* True once the system info's been sent */
+
+	nscmd   *template.Template /* Command to identify to services */
+	cscmd   *template.Template /* Command to send ChanServ after joining */
+	csmcmd  *template.Template /* Command to ask ChanServ for ops/voice */
+	cssent  bool               /* True once cscmd's been sent */
+	csat    time.Time          /* Time to send cscmd, if waiting */
+	modeat  time.Time          /* Time to stop waiting for -cs-op/voice */
+	regcmd  *template.Template /* Command to register our nick */
+	regsent bool               /* True once regcmd's been sent */
+	opped   bool               /* True if we have ops in the channel */
+	voiced  bool               /* True if we have voice in the channel */
+
+	nicklen   int       /* Server's NICKLEN, or 0 if not yet known */
+	nickbase  string    /* Nick last asked for, less nicksfx */
+	nicksfx   string    /* Numbers or the like after nickbase */
+	wantnick  bool      /* True if -nick was taken and -regain was given */
+	regaining bool      /* True while waiting for a nick change */
+	lostnick  string    /* Nick we first asked for, if it was in use */
+	regainat  time.Time /* Time to ask for lostnick back */
+
+	sent []time.Time /* When messages were sent in the last minute */
+
+	unechoed []string /* Messages sent but not yet echoed back */
+
+	recorder *recorder /* Writes channel lines to -record */
+
+	away map[string]bool /* Lowercased nicks known to be away */
+
+	lock *os.File /* Locked lockfile for the pipe */
+
+	instance string /* Prefix from -instance */
+
+	history []historyEvent /* Recent errors and reconnects, for !history */
+
+	sendfails int       /* Failures to send in a row */
+	firstfail time.Time /* Time of the first of sendfails */
+
+	outbox   []outMsg    /* Messages waiting to be sent */
+	nextsend time.Time   /* Time to send the next message in outbox */
+	pastec   chan pasted /* Result of the paste in progress, if any */
+
+	transforms []transform /* Transforms applied to each line */
+	nfooter    int         /* Lines which could have had a footer */
+
+	lastprobe time.Time /* Time the last probe was sent */
+	probesent time.Time /* Time the unanswered probe was sent, if any */
+
+	lastinput time.Time          /* Time the last line was read */
+	resume    *template.Template /* Parsed -resume-notice */
+
+	muted     bool     /* True if we're not sending lines */
+	mutebuf   []string /* Lines read while muted */
+	mutebytes int      /* Bytes in mutebuf */
 }
 
 /* Global name of pipe to remove, if any */
@@ -91,32 +348,39 @@ var rempname string = ""
 var irc *minimalirc.IRC = nil
 
 func main() { /* Signal handlers */
-	ret := 0            /* Return value from main */
-	m := make(chan int) /* Channel on which to get return value */
+	ret := 0               /* Return value from main */
+	m := make(chan int, 1) /* Channel on which to get return value */
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		i := mymain()
+		i := mymain(ctx)
 		m <- i
 	}()
 	/* Set up signal channel */
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	select {
 	case ret = <-m:
 		break
 	case s := <-sigchan:
-		if os.Interrupt != s {
-			verbose("Caught unpossible signal")
+		verbose("Caught %v, exiting", s)
+		/* Exit like the shell would expect */
+		if n, ok := s.(syscall.Signal); ok {
+			ret = exitSignal + int(n)
+		} else {
+			ret = exitCancelled
 		}
-		ret = -5
-	}
-	/* Gracefully quit IRC */
-	if nil != irc {
-		debug("Gracefully QUITting IRC")
-		if err := irc.Quit(""); err != nil {
-			verbose("Error encountered gracefully quitting "+
-				"IRC: %v", err)
+		/* Give mymain a chance to clean up, which includes quitting
+		IRC.  If it doesn't, it may still be using the global state,
+		so we leave it alone. */
+		cancel()
+		select {
+		case <-m:
+		case <-time.After(shutdownwait):
+			verbose("Gave up waiting for a clean shutdown")
+			os.Exit(ret)
 		}
 	}
+	cancel()
 	/* Remove the pipe */
 	if "" != rempname {
 		debug("Removing %v", rempname)
@@ -124,12 +388,16 @@ func main() { /* Signal handlers */
 			verbose("Unable to remove pipe %v: %v", rempname, err)
 		}
 	}
+	/* And its lock, if it's gone */
+	unlockPipe("" != rempname)
 
 	os.Exit(ret)
 }
-func mymain() int {
-	/* Get local hostname for flag default */
+func mymain(ctx context.Context) int {
+	/* Get local hostname for flag default, keeping the whole thing, as n
+	becomes the nick */
 	n, err := os.Hostname()
+	hostname := n
 	gc.nick = &n
 	if nil != err {
 		log.Printf("Unable to determine hostname: %v", err)
@@ -140,71 +408,37 @@ func mymain() int {
 	}
 
 	/* Get options */
-	gc.host = flag.String("host", "chat.freenode.net", "IRC server "+
-		"hostname.")
-	gc.port = flag.Uint("port", 7000, "IRC server port.")
-	gc.ssl = flag.Bool("ssl", true, "Use SSL/TLS.")
-	gc.sslname = flag.String("sslname", "", "Hostname expected on "+
-		"server's SSL certificate.  If this is not specified, and "+
-		"-ssl is, -host will be used.")
-	gc.nick = flag.String("nick", *gc.nick, "IRC nickname.")
-	gc.nums = flag.Bool("nums", true, "Append random numbers to the "+
-		"nick.  Even if this is not given, numbers may still be "+
-		"added in case of a nick conflict (which can happen in some "+
-		"cases if -wait is too short).  The numbers will change "+
-		"every time a new connection is established.")
-	gc.uname = flag.String("uname", "ircstatus", "Username.")
-	gc.rname = flag.String("rname", "Status over IRC", "Real name.")
-	gc.idnick = flag.String("idnick", "", "Nick to use to auth to "+
-		"services.  If this is not specified but idpass is, the nick "+
-		"given by -nick or the nick derived from the hostname will "+
-		"be used.")
-	gc.idpass = flag.String("idpass", "", "Pass to use to auth to "+
-		"services.  If this is not specified and but idnick is, the "+
-		"password will be read from the standard input.")
-	gc.channel = flag.String("channel", "##ircstatushub", "Channel to "+
-		"join.")
-	gc.chanpass = flag.String("chanpass", "hunter2", "Channel "+
-		"password (key).")
-	gc.qmsg = flag.String("qmsg", "https://github.com/kd5pbo/ircstatus",
-		"Message to send when closing connection to IRC server.")
-	gc.pipe = flag.String("pipe", "-", "Pipe from which to read.  This "+
-		"can be \"-\" to indicate stdin, \"nick\" to cause a pipe "+
-		"(i.e. fifo) to be created in "+os.TempDir()+" with the "+
-		"name of the initial nick, or a path (like /tmp/ircstatus) "+
-		"where one will be created if none exists.  Only text data "+
-		"should be sent on this pipe.  Data will be buffered until "+
-		"a newline (or \\r\\n) is read.  Lines too long for one "+
-		"message will be split into smaller lines.  In some cases, "+
-		"with extremely long channel names, certain multi-byte "+
-		"unicode characters may be replaced with a '?'.  If "+
-		"-pipe=nick is given, the created pipe will be removed upon "+
-		"exit.")
-	gc.flush = flag.Bool("flush", true, "Discard all data on the pipe "+
-		"that existed before starting.  Ignored for -pipe=-.")
-	gc.wait = flag.Duration("wait", time.Duration(10)*time.Second,
-		"Time to wait after a failed connection attempt or failed "+
-			"open of -pipe.")
-	gc.senddelay = flag.Duration("senddelay", time.Second, "Time to "+
-		"delay between lines sent to avoid flooding.")
-	gc.verbose = flag.Bool("verbose", false, "Print some non-error output.")
-	gc.debug = flag.Bool("debug", false, "Print more non-error "+
-		"output.  Implies -verbose.  This should be used with care "+
-		"as it could leak passwords.")
-	gc.savehelp = flag.String("savehelp", "", "Does nothing but write "+
-		"this help text to a file.")
-	gc.rxproto = flag.Bool("rxproto", false, "Log received IRC protocol "+
-		"messages.")
-	gc.timeout = flag.Duration("timeout", 3*time.Minute, "Reconnect to "+
-		"the IRC server if no messages has been received in this long.")
-	gc.txlines = flag.Bool("txlines", false, "Log lines sent to IRC "+
-		"server")
+	defineFlags()
 	flag.Parse()
 	/* Set more precision if -debug */
 	if *gc.debug {
 		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	}
-	debug("Local hostname: %v", n)
+
+	/* Put the environment into flags which want it */
+	re.EnvVar = regexp.MustCompile(reEnvVar)
+	if !*gc.noexpand {
+		expandFlags()
+	}
+	debug("Local hostname: %v", hostname)
+	st.hostname = hostname
+	st.started = time.Now()
+
+	/* Make sure hosts without a hostname don't all have the same nick */
+	if !flagSet("nick") && nil != err {
+		if *gc.nick, err = hostlessNick(*gc.hostid); nil != err {
+			fmt.Printf("Unable to make a nick: %v\n", err)
+			return exitConfig
+		}
+		verbose("Nick made without a hostname: %v", *gc.nick)
+	} else if !flagSet("nick") && "short" != *gc.nickfrom {
+		/* Derive the nick differently, if asked */
+		if *gc.nick, err = nickFromHost(*gc.nickfrom); nil != err {
+			fmt.Printf("Unable to derive nick: %v\n", err)
+			return exitConfig
+		}
+		verbose("Nick derived from hostname: %v", *gc.nick)
+	}
 
 	/* Only save the help if requested */
 	if "" != *gc.savehelp {
@@ -215,12 +449,140 @@ func mymain() int {
 	if *gc.port > math.MaxUint16 {
 		fmt.Printf("Port %v is larger than %v.\n", *gc.port,
 			math.MaxUint16)
-		return -3
+		return exitConfig
+	}
+
+	/* There's no paste service we can count on */
+	if 0 < *gc.pasteover && "" == *gc.pasteurl {
+		fmt.Printf("-paste-over needs -paste-url.\n")
+		return exitConfig
+	}
+
+	/* Most NickServs won't register a nick without an email address */
+	if *gc.register && "" == *gc.regemail {
+		fmt.Printf("-register needs -register-email.\n")
+		return exitConfig
 	}
 
+	/* Only two families to choose from */
+	switch *gc.family {
+	case "auto", "4", "6":
+	default:
+		fmt.Printf("-family must be 4, 6, or auto.\n")
+		return exitConfig
+	}
+
+	/* Lines can't be truncated to nothing */
+	if 0 >= *gc.maxline {
+		fmt.Printf("-max-line-bytes must be positive.\n")
+		return exitConfig
+	}
+
+	/* Set up the places to mirror lines */
+	if st.mirrors, err = mirrorSinks(); nil != err {
+		fmt.Printf("Unable to mirror lines: %v\n", err)
+		return exitConfig
+	}
+
+	/* Start recording the channel */
+	if st.recorder, err = startRecorder(); nil != err {
+		fmt.Printf("Unable to record to %v: %v\n", *gc.record, err)
+		return exitConfig
+	}
+
+	/* Make sure we know how to send heartbeats */
+	switch *gc.beatas {
+	case "line", "topic", "away":
+	default:
+		fmt.Printf("Unknown -heartbeat-as %q.\n", *gc.beatas)
+		return exitConfig
+	}
+
+	/* Make sure we know how to split lines */
+	switch *gc.wrap {
+	case "hard", "word":
+	default:
+		fmt.Printf("Unknown -wrap %q.\n", *gc.wrap)
+		return exitConfig
+	}
+
+	/* Parse the quit message */
+	st.qmsg = parseQuitMessage(*gc.qmsg)
+
+	/* Parse the services command templates */
+	if st.nscmd, err = parseCommand("ns-command", *gc.nscmd); nil != err {
+		fmt.Printf("Invalid -ns-command: %v\n", err)
+		return exitConfig
+	}
+	if st.cscmd, err = parseCommand("cs-command", *gc.cscmd); nil != err {
+		fmt.Printf("Invalid -cs-command: %v\n", err)
+		return exitConfig
+	}
+	if st.regcmd, err = parseCommand("register-command",
+		*gc.regcmd); nil != err {
+		fmt.Printf("Invalid -register-command: %v\n", err)
+		return exitConfig
+	}
+	if st.csmcmd, err = parseCommand("cs-mode-command",
+		*gc.csmcmd); nil != err {
+		fmt.Printf("Invalid -cs-mode-command: %v\n", err)
+		return exitConfig
+	}
+
+	/* Parse the resume notice */
+	if st.resume, err = template.New("resume").Funcs(
+		templateFuncs).Parse(*gc.resumemsg); nil != err {
+		fmt.Printf("Invalid -resume-notice: %v\n", err)
+		return exitConfig
+	}
+
+	/* Work out the instance prefix */
+	if st.instance, err = instancePrefix(); nil != err {
+		fmt.Printf("Invalid -instance: %v\n", err)
+		return exitConfig
+	}
+
+	/* Work out how to transform lines */
+	if st.transforms, err = parseTransforms(); nil != err {
+		fmt.Printf("Invalid -transform: %v\n", err)
+		return exitConfig
+	}
+
+	/* Parse the real name template */
+	if st.rname, err = parseRealName(); nil != err {
+		fmt.Printf("Invalid -rname-template: %v\n", err)
+		return exitConfig
+	}
+
+	/* Split the alternate nicks */
+	for _, a := range strings.Split(*gc.altnicks, ",") {
+		if a = strings.TrimSpace(a); "" != a {
+			st.altnicks = append(st.altnicks, a)
+		}
+	}
+	debug("Alternate nicks: %v", st.altnicks)
+
+	/* Split the admin masks */
+	for _, a := range strings.Split(*gc.admins, ",") {
+		if a = strings.TrimSpace(a); "" != a {
+			st.admins = append(st.admins, a)
+		}
+	}
+	debug("Admin masks: %v", st.admins)
+
 	/* Compile regular expressions */
-	re.NickInUse = regexp.MustCompile(reNickInUse)
-	re.ChannelJoined = regexp.MustCompile(reChannelJoined)
+	compileRegexps()
+
+	/* Read the services password from a file if asked */
+	if "" != *gc.idpfile {
+		p, err := readSecretFile(*gc.idpfile)
+		if nil != err {
+			fmt.Printf("Unable to read services password: %v\n",
+				err)
+			return exitConfig
+		}
+		gc.idpass = &p
+	}
 
 	/* Work out whether we should auth to services */
 	if "" != *gc.idnick || "" != *gc.idpass {
@@ -231,13 +593,21 @@ func mymain() int {
 		verbose("Auth nick: %v", *gc.idnick)
 		/* Get a password */
 		if "" == *gc.idpass {
+			/* Don't eat the first line meant for IRC */
+			if passwordFromPipe() {
+				fmt.Printf("Not reading the services " +
+					"password from the standard input, " +
+					"as it's also -pipe.  Please use " +
+					"-idpass or -idpass-file.\n")
+				return exitConfig
+			}
 			/* Try to read a line from stdin */
 			p, err := bufio.NewReader(
 				os.Stdin).ReadString('\n')
 			if err != nil {
 				log.Printf("Unable to read password to auth "+
 					"to services: %v", err)
-				return -5
+				return exitPassword
 			}
 			/* Remove trailing newlines */
 			p = strings.TrimRight(p, "\r\n")
@@ -245,43 +615,137 @@ func mymain() int {
 		}
 		debug("Auth password: %v", *gc.idpass)
 	}
+	if *gc.sasl && "" == *gc.idpass {
+		fmt.Printf("-sasl needs -idnick, -idpass, or -idpass-file.\n")
+		return exitConfig
+	}
+	if *gc.regain && "" == *gc.idpass {
+		fmt.Printf("-regain needs -idnick, -idpass, or " +
+			"-idpass-file.\n")
+		return exitConfig
+	}
+
+	/* Read the channel key from a file if asked */
+	if "" != *gc.cpfile {
+		p, err := readSecretFile(*gc.cpfile)
+		if nil != err {
+			fmt.Printf("Unable to read channel key: %v\n", err)
+			return exitConfig
+		}
+		gc.chanpass = &p
+		debug("Channel key read from %v: %v", *gc.cpfile,
+			redact(p))
+	}
+
+	/* Work out which channels to join */
+	if err := parseChannels(); nil != err {
+		fmt.Printf("Invalid -channel: %v\n", err)
+		return exitConfig
+	}
+	debug("Extra channels: %v", len(st.extras))
 
 	/* SSL hostname, if not specified */
 	if *gc.ssl && "" == *gc.sslname {
 		*gc.sslname = *gc.host
 	}
 
+	/* SIGUSR2 toggles a maintenance pause */
+	st.maint = make(chan os.Signal, 1)
+	signal.Notify(st.maint, syscall.SIGUSR2)
+
+	/* SIGHUP reopens the pipe */
+	st.hup = make(chan os.Signal, 1)
+	signal.Notify(st.hup, syscall.SIGHUP)
+
 	/* Channels (or channel-containing structs) for select */
 	var pipe *Pipe = nil
 
-	/* Kill IRC connection before exit */
+	/* Kill IRC connection and keep the unreplayed backlog before exit */
 	defer func() {
+		requeueFallback()
 		if nil != irc {
 			verbose("Quitting IRC gracefully")
-			irc.Quit("")
+			irc.Quit(quitMessage())
 		}
 	}()
 
-	/* True if we need to make a new IRC or pipe */
-	newIRC := true
+	/* True if we need to make a new pipe or drop the IRC connection */
+	newIRC := false
 	newPipe := true
 
-	/* Buffer for lines to be sent in case the connection dies */
-	var txbuf *string = nil
-
 	/* True when we're actually ready to send IRC messages */
 	ircReady := false
 
 	/* Nick from first IRC connection for use if -pname=nick */
 	onick := ""
 
+	/* Spread out a fleet's joins */
+	if 0 < *gc.stagger {
+		d := time.Duration(rand.Int63n(int64(*gc.stagger)))
+		verbose("Waiting %v before first joining", d)
+		if nil != sleep(ctx, d) {
+			return exitCancelled
+		}
+	}
+
 	/* Main program loop */
 	for {
-		/* Get a channel for IRC messages */
-		if newIRC {
+		/* Stop if we've been told to */
+		if nil != ctx.Err() {
+			debug("Main loop cancelled: %v", ctx.Err())
+			return exitCancelled
+		}
+		/* Get a channel for the pipe, whether or not IRC's there, so
+		lines can go to the fallback file.  A pipe named after the nick
+		has to wait until we know the nick. */
+		if (nil == pipe || newPipe || pipe.closed()) &&
+			!time.Now().Before(st.repipe) &&
+			("nick" != *gc.pipe || "" != onick || nil != irc) {
+			/* Get the real nick */
+			if "nick" == *gc.pipe && "" == onick {
+				/* Try to get the server's idea of the nick */
+				onick = irc.SNick()
+				/* If it fails, revert to the original nick */
+				if "" == onick {
+					onick = *gc.nick
+				}
+			}
+
+			/* Make sure the old reader's stopped, lest it leak */
+			if nil != pipe {
+				pipe.Close()
+			}
+
+			var err error = nil
+			pipe, err = makePipe(ctx, *gc.pipe, onick, *gc.flush)
+			/* Retry if we have an error */
+			if nil != err {
+				verbose("Error opening pipe %v (retry in "+
+					"%v): %v", *gc.pipe, *gc.wait, err)
+				st.repipe = time.Now().Add(*gc.wait)
+				newPipe = true
+			} else {
+				newPipe = false
+				debug("Using pipe: %v", pipe.Pname)
+				/* Remove pipe if we made it before exit */
+				if "nick" == *gc.pipe {
+					rempname = pipe.Pname
+				}
+			}
+		}
+
+		/* Get a channel for IRC messages, when it's time to try and
+		we're not paused for maintenance */
+		if nil == irc && !st.paused && !time.Now().Before(st.redial) {
 			/* Not ready to send messages */
 			ircReady = false
 
+			/* Don't hammer a server which won't have us */
+			if d := shortSessionWait(); 0 != d {
+				st.redial = time.Now().Add(d)
+				continue
+			}
+
 			/* Work out the prefixes */
 			txp := ""
 			rxp := ""
@@ -292,109 +756,715 @@ func mymain() int {
 				txp = "->IRC"
 			}
 			/* Try to connect and get a channel */
+			host, herr := familyHost(ctx)
 			irc = minimalirc.New(
-				*gc.host, uint16(*gc.port), /* Server */
+				host, uint16(*gc.port), /* Server */
 				*gc.ssl, *gc.sslname, /* Use SSL (or not) */
-				*gc.nick, *gc.uname, *gc.rname) /* ID */
+				*gc.nick, *gc.uname, realName()) /* ID */
 			/* Numbers after the nick */
 			irc.RandomNumbers = *gc.nums
 			/* Auth */
-			irc.IdNick = *gc.idnick
-			irc.IdPass = *gc.idpass
-			/* Channel */
-			irc.Channel = *gc.channel
-			irc.Chanpass = *gc.chanpass
+			if nil == st.nscmd && !*gc.sasl {
+				irc.IdNick = *gc.idnick
+				irc.IdPass = *gc.idpass
+			}
+			/* Channel, which we'll join ourselves if we have to
+			wait after registering or for SASL */
+			if !selfJoin() {
+				irc.Channel = *gc.channel
+				irc.Chanpass = *gc.chanpass
+			}
 			/* Log all messages */
 			irc.Txp = txp
 			irc.Rxp = rxp
 			/* Send pongs */
 			irc.Pongs = true
-			/* Quit message */
-			irc.QuitMessage = *gc.qmsg
+			/* Quit message, if it's not a template.  Templates
+			are rendered when we quit, as they'd be stale by
+			now. */
+			if nil == st.qmsg {
+				irc.QuitMessage = *gc.qmsg
+			}
 			/* Set our own idea of pings */
 			irc.Timeout = *gc.timeout
 			/* If it fails, try again in a bit */
-			if err := irc.Connect(); nil != err {
+			err := herr
+			if nil == err {
+				err = connect(ctx, irc)
+			}
+			if nil != err {
 				verbose("Unable to connect to IRC server "+
 					"%v (retry in %v): %v",
 					*gc.host, *gc.wait, err)
-				newIRC = true
-				time.Sleep(*gc.wait)
-				continue
-			}
-			newIRC = false
-		}
-		/* Get a channel for the pipe when IRC is ready */
-		if ircReady && (nil == pipe || newPipe) {
-			/* Get the real nick */
-			if "nick" == *gc.pipe && "" == onick {
-				/* Try to get the server's idea of the nick */
-				onick = irc.SNick()
-				/* If it fails, revert to the original nick */
-				if "" == onick {
-					onick = *gc.nick
+				noteEvent("Unable to connect to %v: %v",
+					*gc.host, err)
+				/* Give up if it's been too many times */
+				st.connfails++
+				if 0 < *gc.retries &&
+					st.connfails > *gc.retries {
+					log.Printf("Giving up after %v failed "+
+						"connection attempts",
+						st.connfails)
+					return exitRetries
 				}
-			}
-
-			var err error = nil
-			pipe, err = makePipe(*gc.pipe, onick, *gc.flush)
-			/* Retry if we have an error */
-			if nil != err {
-				verbose("Error opening pipe %v (retry in "+
-					"%v): %v", *gc.pipe, *gc.wait, err)
-				time.Sleep(*gc.wait)
-				newPipe = true
+				irc = nil
+				st.redial = time.Now().Add(*gc.wait)
 				continue
 			}
-			debug("Using pipe: %v", pipe.Pname)
-			/* Remove pipe if we made it before exit */
-			if "nick" == *gc.pipe {
-				rempname = pipe.Pname
+			/* Start from the first alternate nick again */
+			st.nalt = 0
+			/* Not registered or joined yet */
+			st.registered = time.Time{}
+			st.joinat = time.Time{}
+			st.joinerr = ""
+			forgetChannels()
+			st.rejoinat = time.Time{}
+			st.rejoined = time.Time{}
+			st.nick = ""
+			st.nicklen = 0
+			st.nickbase = *gc.nick
+			st.nicksfx = strings.TrimPrefix(irc.SNick(), *gc.nick)
+			st.wantnick = false
+			st.regaining = false
+			st.lostnick = ""
+			st.regainat = time.Time{}
+			st.cssent = false
+			st.csat = time.Time{}
+			st.modeat = time.Time{}
+			st.saslreq = false
+			st.saslok = false
+			st.unechoed = nil
+			st.away = nil
+			st.lastprobe = time.Time{}
+			st.probesent = time.Time{}
+			st.opped = false
+			st.voiced = false
+			/* Note the connection for the quit message */
+			if !st.connected.IsZero() {
+				st.reconnects++
 			}
-		}
-
-		/* Try to send txbuf before the select */
-		if nil != txbuf {
-			if err := irc.Privmsg(*txbuf, ""); nil != err {
-				verbose("Error sending buffered message: %v",
+			st.connected = time.Now()
+			st.insession = true
+			if *gc.seqreset {
+				st.seq = 0
+			}
+			/* Ask for the IRCv3 capabilities we'd like */
+			if err := requestCaps(mircConn{irc}); nil != err {
+				verbose("Unable to request capabilities: %v",
 					err)
 			}
-			/* Try again in a bit */
-			newIRC = true
-			continue
 		}
-
-		/* Handle an event */
-		newPipe, newIRC, ircReady, txbuf, err = handleEvent(pipe, irc,
-			ircReady, txbuf)
+		/* Handle an event, or wait for one if IRC's not there */
+		var conn ircConn
+		if nil != irc {
+			conn = mircConn{irc}
+		}
+		newPipe, newIRC, ircReady, err = handleEvent(ctx, pipe, conn,
+			ircReady)
+		if newIRC {
+			irc = nil
+			ircReady = false
+			requeueFallback()
+		}
 		if io.EOF == err && nil != pipe && "-" == pipe.Pname {
 			/* End of stdin */
-			return 0
+			return exitOK
+		} else if nil != ctx.Err() {
+			continue
 		} else if err != nil {
 			verbose("Error handling an event: %v", err)
-			return -1
+			return exitError
 		}
 	}
 }
 
+/* defineFlags defines the command-line flags.  The default nick is whatever
+gc.nick points to beforehand. */
+func defineFlags() {
+	gc.host = flag.String("host", "chat.freenode.net", "IRC server "+
+		"hostname.")
+	gc.port = flag.Uint("port", 7000, "IRC server port.")
+	gc.family = flag.String("family", "auto", "Address family to use "+
+		"to connect to -host: 4 for IPv4, 6 for IPv6, or auto for "+
+		"whichever works.  With 4 or 6, -host is looked up before "+
+		"each connection and the first address of that family used, "+
+		"and -sslname defaults to -host as usual.")
+	gc.ssl = flag.Bool("ssl", true, "Use SSL/TLS.")
+	gc.sslname = flag.String("sslname", "", "Hostname expected on "+
+		"server's SSL certificate.  If this is not specified, and "+
+		"-ssl is, -host will be used.")
+	gc.nick = flag.String("nick", *gc.nick, "IRC nickname.")
+	gc.nickfrom = flag.String("nick-from", "short", "How to derive the "+
+		"default nick from the hostname.  This may be \"short\" to "+
+		"use the bit before the first dot, \"fqdn\" to use the "+
+		"whole hostname with dots replaced by dashes (shortened "+
+		"and hashed if it's too long for a nick), or \"hash\" "+
+		"to add a short hash of the whole hostname to the bit "+
+		"before the first dot, which helps with hosts with the "+
+		"same name in different domains.  Ignored if -nick is given.")
+	gc.hostid = flag.String("hostless-id", "machine-id", "If the "+
+		"hostname can't be had, how to keep the default nick (and "+
+		"-pipe=nick's pipe) from being the same as on other such "+
+		"hosts.  This may be \"machine-id\" to add a hash of the "+
+		"machine ID (or a random ID, if there isn't one), \"random\" "+
+		"to add a hash of a random ID kept in ~/"+hostidfile+", or "+
+		"\"none\" to just use \""+defaultnick+"\".  Ignored if "+
+		"-nick is given.")
+	gc.nums = flag.Bool("nums", true, "Append random numbers to the "+
+		"nick.  Even if this is not given, numbers may still be "+
+		"added in case of a nick conflict (which can happen in some "+
+		"cases if -wait is too short).  The numbers will change "+
+		"every time a new connection is established.")
+	gc.altnicks = flag.String("altnicks", "", "Comma-separated list of "+
+		"nicks to try, in order, if the nick is in use.  Random "+
+		"numbers will only be appended to the nick once all of "+
+		"these have been tried.")
+	gc.uname = flag.String("uname", "ircstatus", "Username.")
+	gc.rname = flag.String("rname", "Status over IRC", "Real name.")
+	gc.rnamet = flag.String("rname-template", "", "Go text/template "+
+		"for the real name, rendered on every connect.  "+
+		"{{.Hostname}}, {{.Kernel}}, {{.Uptime}}, and {{.Load}} will "+
+		"be replaced by facts about the local host.  If it can't be "+
+		"rendered, -rname will be used.  Real names longer than "+
+		strconv.Itoa(maxrname)+" bytes will be shortened.")
+	gc.idnick = flag.String("idnick", "", "Nick to use to auth to "+
+		"services.  If this is not specified but idpass is, the nick "+
+		"given by -nick or the nick derived from the hostname will "+
+		"be used.")
+	gc.idpass = flag.String("idpass", "", "Pass to use to auth to "+
+		"services.  If this is not specified and but idnick is, the "+
+		"password will be read from the standard input, unless "+
+		"-pipe=- is given.")
+	gc.idpfile = flag.String("idpass-file", "", "File from which to "+
+		"read the password to use to auth to services.  If given, "+
+		"this takes precedence over -idpass.")
+	gc.regain = flag.Bool("regain", false, "If -nick is in use when "+
+		"connecting, ask NickServ to GHOST whatever has it once "+
+		"we're registered under another nick, and then try to "+
+		"change back to it.  This is only tried once a connection.  "+
+		"Needs -idpass or -idpass-file.")
+	gc.sasl = flag.Bool("sasl", false, "Auth with SASL PLAIN while "+
+		"connecting, using -idnick and -idpass, instead of to "+
+		"NickServ after registering.  The channel isn't joined until "+
+		"it's succeeded.  If the server refuses SASL or the "+
+		"credentials, ircstatus quits; it won't fall back to "+
+		"NickServ.  The library sends NICK and USER as it connects, "+
+		"so CAP LS can only follow them; this relies on the server "+
+		"holding registration for CAP, as IRCv3 servers should if "+
+		"CAP arrives before registration's done.")
+	gc.nscmd = flag.String("ns-command", "", "Go text/template for "+
+		"the raw IRC line to send to identify to services, for "+
+		"networks which don't do it the usual way (e.g. PRIVMSG "+
+		"NickServ :IDENTIFY {{.IdNick}} {{.Pass}}).  It's sent once "+
+		"registered with the server, instead of the usual "+
+		"identification.  {{.Nick}}, {{.IdNick}}, {{.Pass}}, "+
+		"{{.Channel}}, and {{.Key}} will be replaced by our nick, "+
+		"-idnick, -idpass, -channel, and -chanpass.")
+	gc.cscmd = flag.String("cs-command", "", "Go text/template for a "+
+		"raw IRC line to send after joining the channel (e.g. "+
+		"PRIVMSG ChanServ :VOICE {{.Channel}}).  The same "+
+		"replacements as -ns-command are made.")
+	gc.register = flag.Bool("register", false, "If NickServ says the "+
+		"nick isn't registered, register it with -idpass and "+
+		"-register-email, using -register-command.  This is only "+
+		"tried once per run.")
+	gc.regemail = flag.String("register-email", "", "Email address "+
+		"to give NickServ with -register, which needs it.")
+	gc.regcmd = flag.String("register-command", "PRIVMSG NickServ "+
+		":REGISTER {{.Pass}} {{.Email}}", "Go text/template for the "+
+		"raw IRC line to send to register the nick with -register.  "+
+		"The same replacements as -ns-command are made, and "+
+		"{{.Email}} will be replaced by -register-email.")
+	gc.csop = flag.Bool("cs-op", false, "Ask ChanServ for ops after "+
+		"joining the channel, using -cs-mode-command.  Lines wait "+
+		"until we're opped, for up to "+csmodewait.String()+".")
+	gc.csvoice = flag.Bool("cs-voice", false, "Ask ChanServ for voice "+
+		"after joining the channel, using -cs-mode-command.  Useful "+
+		"for moderated channels.  Lines wait until we're voiced (or "+
+		"opped), for up to "+csmodewait.String()+".")
+	gc.csmcmd = flag.String("cs-mode-command", "PRIVMSG ChanServ "+
+		":{{.Mode}} {{.Channel}} {{.Nick}}", "Go text/template for "+
+		"the raw IRC line to send to ask for ops or voice with "+
+		"-cs-op or -cs-voice.  The same replacements as -ns-command "+
+		"are made, and {{.Mode}} will be replaced by OP or VOICE.")
+	gc.channel = flag.String("channel", "##ircstatushub", "Channel to "+
+		"join.  This may be a comma-separated list of channels, "+
+		"each optionally followed by :key, in which case lines are "+
+		"sent to all of them.  -chanpass and the services flags "+
+		"apply to the first channel.  Lines are sent once any of "+
+		"them is joined, to those which are.")
+	gc.chanpass = flag.String("chanpass", "hunter2", "Channel "+
+		"password (key).")
+	gc.cpfile = flag.String("chanpass-file", "", "File from which to "+
+		"read the channel password (key).  If given, this takes "+
+		"precedence over -chanpass, and keeps the key out of the "+
+		"process list.")
+	gc.qmsg = flag.String("qmsg", "https://github.com/kd5pbo/ircstatus",
+		"Message to send when closing connection to IRC server.  "+
+			"This may be a Go text/template, in which case "+
+			"{{.Uptime}}, {{.Lines}}, and {{.Reconnects}} will be "+
+			"replaced by the time connected, the number of lines "+
+			"sent, and the number of reconnects.  If it's not a "+
+			"valid template it will be sent as-is.")
+	gc.pipe = flag.String("pipe", "-", "Pipe from which to read.  This "+
+		"can be \"-\" to indicate stdin, \"nick\" to cause a pipe "+
+		"(i.e. fifo) to be created in "+os.TempDir()+" with the "+
+		"name of the initial nick, or a path (like /tmp/ircstatus) "+
+		"where one will be created if none exists.  Only text data "+
+		"should be sent on this pipe.  Data will be buffered until "+
+		"a newline (or \\r\\n) is read.  Lines too long for one "+
+		"message will be split into smaller lines.  In some cases, "+
+		"with extremely long channel names, certain multi-byte "+
+		"unicode characters may be replaced with a '?'.  If "+
+		"-pipe=nick is given, the created pipe will be removed upon "+
+		"exit.")
+	gc.pinsecure = flag.Bool("pipe-insecure", false, "Use an existing "+
+		"pipe even if it's owned by another user.  Normally this is "+
+		"refused, as another user could have made it to feed us "+
+		"lines.")
+	gc.nolock = flag.Bool("no-lock", false, "Don't take a lock on "+
+		"the pipe (with a lockfile named after it with .lock on the "+
+		"end).  The lock keeps two instances from reading the same "+
+		"pipe, which would split the lines between them.")
+	gc.noexpand = flag.Bool("no-expand", false, "Don't replace ${VAR} "+
+		"with the environment variable VAR in -host, -nick, -uname, "+
+		"-rname, -idnick, -channel, -chanpass, -qmsg, -pipe, "+
+		"-heartbeat-msg, -mirror-file, -record, -fallback-file, "+
+		"-instance, and -footer.  Templates may use {{env \"VAR\"}} "+
+		"either way.")
+	gc.flush = flag.Bool("flush", true, "Discard all data on the pipe "+
+		"that existed before starting.  Ignored for -pipe=-.")
+	gc.maxline = flag.Int("max-line-bytes", 64*1024, "Lines read from "+
+		"the pipe longer than this many bytes will be truncated, with "+
+		"a warning logged.")
+	gc.ftimeout = flag.Duration("flush-timeout", 2*time.Second, "Time "+
+		"to wait for the pipe to flush before giving up and "+
+		"reading it anyways.")
+	gc.wait = flag.Duration("wait", time.Duration(10)*time.Second,
+		"Time to wait after a failed connection attempt or failed "+
+			"open of -pipe.")
+	gc.retries = flag.Int("maxretries", 0, "If positive, give up and "+
+		"exit with status "+strconv.Itoa(exitRetries)+" after "+
+		"this many failed connection attempts in a row, not "+
+		"counting the first.  A connection which gets as far as "+
+		"registering with the server starts the count again.")
+	gc.stagger = flag.Duration("join-stagger", 0, "Wait a random time, "+
+		"up to this long, before first connecting and joining the "+
+		"channel, so a fleet of hosts started at once doesn't all "+
+		"join at once.  Reconnects aren't affected.")
+	gc.shortsess = flag.Duration("short-session", 10*time.Second,
+		"If the connection to the IRC server is lost this soon after "+
+			"it's made "+strconv.Itoa(shortcount)+" or more "+
+			"times in a row, wait longer and longer before "+
+			"reconnecting, up to "+maxbackoff.String()+", as the "+
+			"server is probably killing us on sight.  A duration "+
+			"of 0 disables this.")
+	gc.senddelay = flag.Duration("senddelay", time.Second, "Time to "+
+		"delay between lines sent to avoid flooding.")
+	gc.rate = flag.Int("rate", 0, "If positive, send no more than this "+
+		"many messages in any "+ratewindow.String()+".  Up to this "+
+		"many may be sent in a burst, -senddelay apart.  Whichever "+
+		"of this and -senddelay is stricter wins.")
+	gc.sendfails = flag.Int("send-failures", 1, "Number of times in a "+
+		"row sending a message may fail before reconnecting.  Until "+
+		"then, the message is resent on the same connection, which "+
+		"rides out brief hiccups.")
+	gc.sfwindow = flag.Duration("send-failure-window", time.Minute,
+		"Reconnect if sending's still failing this long after the "+
+			"first failure, even if there's been fewer than "+
+			"-send-failures.  0 disables.")
+	gc.jitter = flag.Duration("senddelay-jitter", 0, "Randomly "+
+		"lengthen or shorten each -senddelay by up to this much, to "+
+		"look less like a bot and keep many hosts from sending in "+
+		"lockstep.  The delay will never be shorter than "+
+		minsenddelay.String()+" (or -senddelay, if that's shorter).")
+	gc.fold = flag.Bool("fold-prefix", false, "Within a burst of "+
+		"lines, replace a long prefix shared with the previous line "+
+		"with \"↳ \".  Lines more than "+burstgap.String()+
+		" apart are not considered part of the same burst.")
+	gc.verbose = flag.Bool("verbose", false, "Print some non-error output.")
+	gc.debug = flag.Bool("debug", false, "Print more non-error "+
+		"output.  Implies -verbose.  This should be used with care "+
+		"as it could leak passwords.")
+	gc.savehelp = flag.String("savehelp", "", "Does nothing but write "+
+		"this help text to a file.")
+	gc.shformat = flag.String("savehelp-format", "text", "Format of "+
+		"the help text saved by -savehelp.  This may be \"text\" "+
+		"or \"json\", which lists each flag's name, type, default, "+
+		"and usage.")
+	gc.rxproto = flag.Bool("rxproto", false, "Log received IRC protocol "+
+		"messages.")
+	gc.timeout = flag.Duration("timeout", 3*time.Minute, "Reconnect to "+
+		"the IRC server if no messages has been received in this long.")
+	gc.ctimeout = flag.Duration("connect-timeout", 0, "Give up and "+
+		"try again if connecting to the IRC server and joining the "+
+		"channel takes longer than this, for servers which accept "+
+		"connections but never finish registering.  A timeout of 0 "+
+		"waits forever, or for -join-timeout after registering.")
+	gc.probeint = flag.Duration("probe-every", 0, "If not 0, this "+
+		"often ask for the channel's topic, and reconnect if the "+
+		"server doesn't answer within -probe-timeout or says we're "+
+		"not in the channel.  This catches being left alone in a "+
+		"split-off copy of the channel.")
+	gc.probewait = flag.Duration("probe-timeout", time.Minute, "Time "+
+		"to wait for a reply to a -probe-every probe.")
+	gc.wtimeout = flag.Duration("write-timeout", time.Minute, "Reconnect "+
+		"to the IRC server if sending a message takes longer than "+
+		"this.  A timeout of 0 waits forever.")
+	gc.tags = flag.Bool("tags", false, "If the server supports the "+
+		"IRCv3 message-tags capability, tag each message with "+
+		"+ircstatus/host=<hostname>.")
+	gc.beat = flag.Duration("heartbeat", 0, "If no lines have been "+
+		"sent in this long, send -heartbeat-msg to show we're still "+
+		"alive.  A heartbeat of 0 disables heartbeats.")
+	gc.beatmsg = flag.String("heartbeat-msg", "Still alive", "Heartbeat "+
+		"message.")
+	gc.beatas = flag.String("heartbeat-as", "line", "How to send the "+
+		"heartbeat message.  This may be \"line\" to send it like "+
+		"any other line, \"topic\" to set it as the channel's topic, "+
+		"or \"away\" to set it as an away message.")
+	gc.jtimeout = flag.Duration("join-timeout", time.Minute, "Reconnect "+
+		"if no channel has been joined this long after the "+
+		"server accepts the connection, logging why, if known.  "+
+		"Other channels not joined this long after asking are "+
+		"given up on.")
+	gc.rejoin = flag.Duration("rejoindelay", 5*time.Second, "Time to "+
+		"wait before rejoining a channel after being kicked.  If "+
+		"we're kicked again within "+kickwindow.String()+", the "+
+		"wait is -wait, doubled for every kick in a row, if that's "+
+		"longer.")
+	gc.persjoin = flag.Bool("persistjoin", true, "If the server won't "+
+		"let us join the channel because it's full, invite-only, "+
+		"we're banned, or the key is wrong, try again after -wait.  "+
+		"With -persistjoin=false, ircstatus exits instead.")
+	gc.hsdelay = flag.Duration("handshake-delay", 0, "Wait this long "+
+		"after registering with the server before joining the "+
+		"channel, and again after joining before sending anything, "+
+		"for servers which don't like commands too soon.")
+	gc.replay = flag.Bool("replay-on-join", false, "Privately send "+
+		"the last few lines sent to the channel (as NOTICEs) to "+
+		"users who join it.  Users who rejoin soon after a replay "+
+		"won't get another one.")
+	gc.nreplay = flag.Int("replay-lines", 10, "Number of lines to "+
+		"replay with -replay-on-join, up to "+
+		strconv.Itoa(maxreplay)+".")
+	gc.mfile = flag.String("mirror-file", "", "File to which to "+
+		"append a copy of every message sent to IRC.")
+	gc.murl = flag.String("mirror-url", "", "URL to which to POST a "+
+		"copy of every message sent to IRC.")
+	gc.record = flag.String("record", "", "File to which to append "+
+		"what others say in the channel, with timestamps.")
+	gc.signkey = flag.String("sign-key", "", "If set, append a short "+
+		"HMAC of each message, made with this key and our nick, so "+
+		"readers can tell the message came from that nick on a host "+
+		"with the key.  Lines recorded with -record will be marked "+
+		"as signed, unsigned, or having a bad signature.")
+	gc.recmax = flag.Int64("record-max-bytes", 10*1024*1024, "Once "+
+		"the -record file is this big, it's renamed with .1 on the "+
+		"end, replacing any older one, and a new one is started.  "+
+		"If 0, the file is never rotated.")
+	gc.stdout = flag.Bool("stdout", false, "Write a copy of every "+
+		"message sent to IRC to the standard output, after it's "+
+		"been split, to see exactly what's sent.")
+	gc.stdoutmrk = flag.String("stdout-marker", "", "Text to put in "+
+		"front of each message written with -stdout.")
+	gc.fbfile = flag.String("fallback-file", "", "If IRC has been "+
+		"unavailable for longer than -fallback-after, append lines "+
+		"read from the pipe to this file instead of leaving them in "+
+		"the pipe.  The pipe is opened at startup, so this works "+
+		"even if IRC's never been reached, except with -pipe=nick, "+
+		"which isn't opened until the first connection gives us a "+
+		"nick.")
+	gc.fbafter = flag.Duration("fallback-after", 5*time.Minute, "Time "+
+		"IRC must be unavailable before lines are written to "+
+		"-fallback-file.")
+	gc.fbreplay = flag.Bool("fallback-replay", false, "Send the lines "+
+		"in -fallback-file to the channel once IRC is available "+
+		"again, and remove them from the file.  Without this, the "+
+		"file is left as an archive.")
+	gc.rpdelay = flag.Duration("replay-delay", 0, "Time to delay "+
+		"between lines replayed from -fallback-file, if not "+
+		"-senddelay.  A shorter delay than -senddelay gets through "+
+		"a backlog faster; -rate still applies.")
+	gc.rpnth = flag.Int("replay-progress", 0, "While replaying "+
+		"-fallback-file, send a progress notice every this many "+
+		"lines.  0 disables.")
+	gc.rpevery = flag.Duration("replay-progress-every", 0,
+		"While replaying -fallback-file, send a progress notice if "+
+			"there's been none for this long.  0 disables.")
+	gc.rpquiet = flag.Bool("replay-quiet", false, "Don't send "+
+		"progress notices while replaying -fallback-file.")
+	gc.clusters = flag.Bool("graphemes", false, "When splitting long "+
+		"lines, keep grapheme clusters (e.g. characters with "+
+		"combining marks, emoji with skin tones, and flags) together, "+
+		"not just runes.")
+	gc.wrap = flag.String("wrap", "hard", "How to split long lines: "+
+		"hard (wherever the line gets too long) or word (at the "+
+		"last space before then, if there is one, removing the "+
+		"spaces at the break).  Words too long for a message are "+
+		"split hard either way.")
+	gc.seq = flag.Bool("seq", false, "Prefix each line with [N], where "+
+		"N counts up from 1, to make it easy to see if lines are "+
+		"lost or reordered.  Numbering continues across reconnects.")
+	gc.muteline = flag.String("mute-line", "", "If set, an input "+
+		"line consisting of exactly this will mute output (or "+
+		"unmute it, if already muted) without disconnecting.  "+
+		"Admins may also use !mute and !unmute.")
+	gc.mutedrop = flag.Bool("mute-drop", false, "Drop lines read while "+
+		"muted, instead of sending them when unmuted.  At most "+
+		fmt.Sprintf("%v", maxmuted)+" lines are kept otherwise.")
+	gc.mbufbytes = flag.Int("max-buffer-bytes", 0, "If positive, the "+
+		"most bytes of lines to keep while muted, on top of the "+
+		fmt.Sprintf("%v", maxmuted)+"-line limit.  The oldest lines "+
+		"are dropped to make room.")
+	gc.skipblank = flag.Bool("skip-blank", true, "Don't send empty or "+
+		"whitespace-only lines.  Set to false to send them anyways, "+
+		"for spacing.")
+	gc.instance = flag.String("instance", "", "If set, prefix each "+
+		"line with this in brackets, to tell apart several "+
+		"instances on the same host.  This is a Go text/template, "+
+		"in which {{.PID}} and {{.Hostname}} will be replaced by "+
+		"our PID and the local hostname.  Lines too long for one "+
+		"message only get the prefix on the first one.")
+	gc.resumegap = flag.Duration("resume-after", 0, "If a line is "+
+		"read more than this long after the previous one, put "+
+		"-resume-notice in front of it.  0 disables this.")
+	gc.resumemsg = flag.String("resume-notice", "(feed resumed after "+
+		"{{.Gap}} of silence)", "Go text/template for the note put "+
+		"in front of a line read after more than -resume-after of "+
+		"silence.  {{.Gap}} will be replaced by how long it was.")
+	gc.transform = flag.String("transform", "", "Comma-separated "+
+		"list of transforms to apply to each line, in order, before "+
+		"it's split and sent.  Transforms are "+
+		strings.Join(transformNames(), ", ")+".  By default, the "+
+		"ones turned on by -skip-blank, -resume-after, "+
+		"-fold-prefix, -tsprefix, -seq, -instance, and "+
+		"-footer-every are applied, in that order.  If given, "+
+		"those flags only configure their transforms.")
+	gc.tsprefix = flag.String("tsprefix", "", "If set, a Go time "+
+		"layout (e.g. 15:04:05) for the time each line is read, "+
+		"which is put in front of the line.  Lines too long for "+
+		"one message only get it on the first one.")
+	gc.hostpfx = flag.Bool("hostprefix", false, "Put the short "+
+		"hostname in front of each message, including each part of "+
+		"a line too long for one message, to tell hosts sharing a "+
+		"channel apart.")
+	gc.action = flag.Bool("action", false, "Send lines as actions, "+
+		"like /me.  Each part of a line too long for one message is "+
+		"its own action.  Mirrors get the line without the CTCP "+
+		"framing.")
+	gc.footernth = flag.Int("footer-every", 0, "If positive, add "+
+		"-footer to the end of every this many lines.  Lines too "+
+		"long for one message only get it on the last one.")
+	gc.footer = flag.String("footer", "", "Footer to add to lines "+
+		"with -footer-every, e.g. a link to a dashboard.")
+	gc.seqreset = flag.Bool("seq-reset", false, "Restart -seq "+
+		"numbering from 1 on every reconnect.")
+	gc.pasteover = flag.Int("paste-over", 0, "If a line would need "+
+		"more than this many messages, upload it to -paste-url and "+
+		"send the link instead.  If the upload fails, the line will "+
+		"be sent as usual.  0 disables pasting.")
+	gc.pasteurl = flag.String("paste-url", "", "URL to which to POST "+
+		"long lines for -paste-over, which needs it.  The response "+
+		"body should be the URL of the paste.")
+	gc.pastefld = flag.String("paste-field", "f:1", "Form field in "+
+		"which to POST the line to -paste-url.")
+	gc.umodes = flag.String("umodes", "", "User modes to set once "+
+		"registered with the server (e.g. +iB).  Modes the server "+
+		"doesn't know are logged and ignored.")
+	gc.admins = flag.String("admin", "", "Comma-separated list of "+
+		"nick!user@host masks (e.g. *!*@trusted.example.com) of "+
+		"users allowed to send the bot commands.  Commands are "+
+		"!status, !uptime, !reconnect, !mute, !unmute, and "+
+		"!history [N] (the last N connection errors and reconnects, "+
+		"as JSON), and may be sent to the channel or to the bot.  "+
+		"Replies are sent as NOTICEs.")
+	gc.sysinfo = flag.Bool("sysinfo", false, "After first joining the "+
+		"channel, send a summary of the local host's hostname, "+
+		"uptime, load, and kernel.")
+	gc.echomsg = flag.Bool("echo-message", false, "Ask the server to "+
+		"echo our messages back to us (the IRCv3 echo-message "+
+		"capability).  Echoed messages, like those replayed by "+
+		"bouncers, are never treated as commands.")
+	gc.verifylen = flag.Bool("verify-length", false, "Ask for the "+
+		"echo-message capability and log a warning when a message "+
+		"comes back shorter than it was sent, which means the "+
+		"server truncated it.")
+	gc.txlines = flag.Bool("txlines", false, "Log lines sent to IRC "+
+		"server")
+}
+
+/* compileRegexps compiles the regular expressions used to parse lines from
+the server */
+func compileRegexps() {
+	re.NickInUse = regexp.MustCompile(reNickInUse)
+	re.NickError = regexp.MustCompile(reNickError)
+	re.Names = regexp.MustCompile(reNames)
+	re.EndOfNames = regexp.MustCompile(reEndOfNames)
+	re.Cap = regexp.MustCompile(reCap)
+	re.Welcome = regexp.MustCompile(reWelcome)
+	re.JoinError = regexp.MustCompile(reJoinError)
+	re.Join = regexp.MustCompile(reJoin)
+	re.Nick = regexp.MustCompile(reNick)
+	re.UmodeUnknown = regexp.MustCompile(reUmodeUnknown)
+	re.Privmsg = regexp.MustCompile(rePrivmsg)
+	re.ISupport = regexp.MustCompile(reISupport)
+	re.Mode = regexp.MustCompile(reMode)
+	re.NickServ = regexp.MustCompile(reNickServ)
+	re.Away = regexp.MustCompile(reAway)
+	re.ProbeReply = regexp.MustCompile(reProbeReply)
+	re.Authenticate = regexp.MustCompile(reAuthenticate)
+	re.SASL = regexp.MustCompile(reSASL)
+	re.Kick = regexp.MustCompile(reKick)
+}
+
 /* Wait for something to happen, handle it */
-func handleEvent(pipe *Pipe, irc *minimalirc.IRC, iircReady bool,
-	itxbuf *string) (newPipe bool, newIRC bool,
-	ircReady bool, txbuf *string, err error) {
+func handleEvent(ctx context.Context, pipe *Pipe, irc ircConn,
+	iircReady bool) (newPipe bool, newIRC bool, ircReady bool, err error) {
 
 	/* We actually use output arguments */
 	ircReady = iircReady
-	txbuf = itxbuf
+
+	/* Note when IRC went away */
+	if ircReady {
+		st.down = time.Time{}
+	} else if st.down.IsZero() {
+		st.down = time.Now()
+	}
+
+	/* Send anything saved while IRC was down, a line at a time */
+	if ircReady {
+		if err = queueFallback(irc); nil != err {
+			err = errors.New(fmt.Sprintf("Error replaying %v: %v",
+				*gc.fbfile, err))
+			quit(irc)
+			newIRC = true
+			return
+		}
+	}
+
+	/* Send anything saved while muted, a line at a time */
+	if ircReady {
+		queueMuted(irc)
+	}
 
 	/* Set the pipe channel in the select to nil if we've not yet got in
-	the IRC channel */
+	the IRC channel or are still sending the last line, unless IRC's been
+	gone long enough to fall back to a file */
 	var p <-chan string
-	if !ircReady || nil == pipe {
+	fallback := !ircReady && fallingBack()
+	if (!fallback && (!ircReady || outboxBusy())) || nil == pipe {
 		p = nil
 	} else {
 		p = pipe.R
 	}
 
+	/* Wake up when it's time to fall back */
+	var fbwait <-chan time.Time
+	if !ircReady && !fallback && "" != *gc.fbfile {
+		fbwait = time.After(st.down.Add(*gc.fbafter).Sub(time.Now()))
+	}
+
+	/* Time to send the next message, if there is one */
+	var drain <-chan time.Time
+	if ircReady && 0 != len(st.outbox) && st.modeat.IsZero() {
+		drain = time.After(st.nextsend.Sub(time.Now()))
+	}
+
+	/* A long line's been pasted, once we can send the link */
+	var pastec <-chan pasted
+	if ircReady {
+		pastec = st.pastec
+	}
+
+	/* Time until the next heartbeat, if we're sending them */
+	var beat <-chan time.Time
+	if ircReady && 0 != *gc.beat {
+		beat = time.After(nextHeartbeat().Sub(time.Now()))
+	}
+
+	/* Try IRC again when it's time, unless we're paused */
+	var redial <-chan time.Time
+	if nil == irc && !st.paused {
+		redial = time.After(st.redial.Sub(time.Now()))
+	}
+
+	/* Try the pipe again when it's time */
+	var repipe <-chan time.Time
+	if nil == pipe && !st.repipe.IsZero() {
+		repipe = time.After(st.repipe.Sub(time.Now()))
+	}
+
+	/* Give up on the whole connection after a while */
+	var connwait <-chan time.Time
+	if nil != irc && !ircReady && !st.connected.IsZero() &&
+		0 != *gc.ctimeout &&
+		st.rejoinat.IsZero() && st.rejoined.IsZero() {
+		connwait = time.After(st.connected.Add(
+			*gc.ctimeout).Sub(time.Now()))
+	}
+
+	/* Make sure we're really in the channel every so often */
+	var probe <-chan time.Time
+	if ircReady && st.inchan && 0 != *gc.probeint {
+		probe = time.After(nextProbe().Sub(time.Now()))
+	}
+
+	/* Give up on joining after a while, once registered or rejoining */
+	var joinwait <-chan time.Time
+	if nil != irc && !ircReady && !st.registered.IsZero() &&
+		0 != *gc.jtimeout && st.rejoinat.IsZero() {
+		s := st.registered
+		if st.rejoined.After(s) {
+			s = st.rejoined
+		}
+		joinwait = time.After(s.Add(*gc.jtimeout).Sub(time.Now()))
+	}
+
+	/* Give up on each of the other channels after a while */
+	var extrawait <-chan time.Time
+	if nil != irc && 0 != *gc.jtimeout {
+		if t := nextExtraTimeout(); !t.IsZero() {
+			extrawait = time.After(t.Sub(time.Now()))
+		}
+	}
+
+	/* Ask for our nick back once NickServ's had a chance to free it */
+	var regain <-chan time.Time
+	if nil != irc && !st.regainat.IsZero() {
+		regain = time.After(st.regainat.Sub(time.Now()))
+	}
+
+	/* Join once -handshake-delay is up */
+	var joindue <-chan time.Time
+	if nil != irc && !st.joinat.IsZero() {
+		joindue = time.After(st.joinat.Sub(time.Now()))
+	}
+
+	/* Talk to ChanServ once -handshake-delay is up */
+	var csdue <-chan time.Time
+	if nil != irc && !st.csat.IsZero() {
+		csdue = time.After(st.csat.Sub(time.Now()))
+	}
+
+	/* Stop waiting for ChanServ to op or voice us after a while */
+	var modedue <-chan time.Time
+	if nil != irc && !st.modeat.IsZero() {
+		modedue = time.After(st.modeat.Sub(time.Now()))
+	}
+
+	/* Rejoin after being kicked or refused */
+	var rejoin <-chan time.Time
+	if nil != irc && !st.rejoinat.IsZero() {
+		rejoin = time.After(st.rejoinat.Sub(time.Now()))
+	}
+
+	/* Lines from IRC, if it's there */
+	var lines <-chan string
+	if nil != irc {
+		lines = irc.Lines()
+	}
+
 	/* KQueueish select */
 	select {
 	case l, ok := <-p: /* Line to send */
@@ -408,66 +1478,388 @@ func handleEvent(pipe *Pipe, irc *minimalirc.IRC, iircReady bool,
 			err = errors.New(fmt.Sprintf("Error reading from "+
 				"pipe: %v", err))
 			newPipe = true
+			break
+		}
+		/* Mute or unmute, if asked */
+		if "" != *gc.muteline && *gc.muteline == l {
+			setMute(!st.muted, "input line")
+			break
 		}
-		/* Store the line in the TX buffer */
-		txbuf = &l
-
-		/* Work out the max size of a message */
-		max := irc.PrivmsgSize("")
 
-		/* Put the strings into an array */
-		txarr := ArrayOfShortStrings(l, max)
+		/* Format the line, or drop it */
+		var keep bool
+		if l, keep = transformLine(l); !keep {
+			break
+		}
 
-		/* Send message to IRC server */
-		for _, m := range txarr {
-			if err = irc.Privmsg(m, ""); nil != err {
-				err = errors.New(fmt.Sprintf("Error sending "+
-					"message: %v", err))
-				irc.Quit("")
-				newIRC = true
-				break
+		/* Save the line for later if IRC isn't there */
+		if fallback {
+			if err = fallbackWrite(l); nil != err {
+				err = errors.New(fmt.Sprintf("Error writing "+
+					"to %v: %v", *gc.fbfile, err))
 			}
-			/* Delay after sending a picture */
-			time.Sleep(*gc.senddelay)
+			break
+		}
+
+		/* Hold on to it if we're muted */
+		if st.muted {
+			muteLine(l)
+			break
+		}
+
+		/* Queue it to be sent to IRC and any mirrors */
+		queueLine(irc, l, false)
+	case pd := <-pastec: /* Long line pasted */
+		queuePasted(irc, pd)
+	case <-drain: /* Time to send the next message */
+		if e := sendQueued(irc); nil != e {
+			verbose("Error sending message (reconnecting): %v", e)
+			noteEvent("Error sending message: %v", e)
+			quit(irc)
+			newIRC = true
+		}
+	case <-fbwait: /* IRC's been down too long */
+		verbose("IRC unavailable for %v, writing lines to %v",
+			*gc.fbafter, *gc.fbfile)
+	case <-st.hup: /* Time to reopen the pipe */
+		if nil == pipe || "-" == pipe.Pname {
+			verbose("Caught SIGHUP, but there's no pipe to reopen")
+			break
+		}
+		verbose("Caught SIGHUP, reopening %v", pipe.Pname)
+		pipe.Close()
+		newPipe = true
+	case <-st.maint: /* Maintenance started or ended */
+		toggleMaintenance()
+	case <-redial: /* Time to try IRC again */
+	case <-repipe: /* Time to try the pipe again */
+	case <-beat: /* Nothing sent in a while */
+		if err = heartbeat(irc); nil != err {
+			err = errors.New(fmt.Sprintf("Error sending "+
+				"heartbeat: %v", err))
+			quit(irc)
+			newIRC = true
+		}
+	case <-probe: /* Time to check we're in the channel */
+		if !st.probesent.IsZero() {
+			verbose("No reply to probe of %v after %v (reconnect "+
+				"in %v)", *gc.channel, *gc.probewait, *gc.wait)
+			noteEvent("No reply to probe of %v", *gc.channel)
+			quit(irc)
+			st.redial = time.Now().Add(*gc.wait)
+			newIRC = true
+			break
 		}
-		/* If the message(s) sent ok, clear the TX buffer and sleep to
-		avoid flooding. */
-		if nil == err {
-			txbuf = nil
-			/* Sleep a bit to avoid flooding */
-			time.Sleep(*gc.senddelay)
+		if e := sendProbe(irc); nil != e {
+			verbose("Error probing %v: %v", *gc.channel, e)
+			quit(irc)
+			newIRC = true
+		}
+	case <-joindue: /* Registered a while ago */
+		if e := joinRegistered(irc); nil != e {
+			verbose("Error joining: %v", e)
+			quit(irc)
+			newIRC = true
+		}
+	case <-csdue: /* Joined a while ago */
+		if e := sendChanServ(irc); nil != e {
+			verbose("Error talking to ChanServ: %v", e)
+			quit(irc)
+			newIRC = true
+		}
+	case <-modedue: /* ChanServ didn't op or voice us */
+		verbose("ChanServ didn't set our modes in %v, sending anyway",
+			csmodewait)
+		st.modeat = time.Time{}
+	case <-rejoin: /* Kicked or refused a while ago */
+		if e := rejoinChannels(irc); nil != e {
+			verbose("Error rejoining: %v", e)
+			quit(irc)
+			newIRC = true
 		}
-	case l, ok := <-irc.C: /* Message from IRC server */
+	case <-regain: /* Our nick should be free */
+		if e := reclaimNick(irc); nil != e {
+			verbose("Error regaining nick: %v", e)
+			quit(irc)
+			newIRC = true
+		}
+	case <-extrawait: /* No answer to a JOIN for another channel */
+		expireExtras()
+	case <-joinwait: /* Registered, but never joined */
+		verbose("Unable to join %v after %v (reconnect in %v): %v",
+			*gc.channel, *gc.jtimeout, *gc.wait, joinDiagnostic())
+		noteEvent("Unable to join %v: %v", *gc.channel,
+			joinDiagnostic())
+		quit(irc)
+		st.redial = time.Now().Add(*gc.wait)
+		newIRC = true
+	case <-connwait: /* Connected, but never got anywhere */
+		verbose("Not in %v %v after connecting (reconnect in %v): %v",
+			*gc.channel, *gc.ctimeout, *gc.wait, joinDiagnostic())
+		noteEvent("Not in %v %v after connecting", *gc.channel,
+			*gc.ctimeout)
+		quit(irc)
+		st.redial = time.Now().Add(*gc.wait)
+		newIRC = true
+	case <-ctx.Done(): /* Time to go */
+		err = ctx.Err()
+	case l, ok := <-lines: /* Message from IRC server */
 		/* Check if connection died */
 		if !ok {
 			/* Get the error */
-			err := <-irc.E
+			err := <-irc.Errors()
 			/* Try to close the connection, for just in
 			case */
-			if e := irc.Quit(*gc.qmsg); e != nil {
-				debug("Error closing connection to "+
-					"the IRC server: %v", e)
-			}
+			quit(irc)
 			verbose("IRC server error (reconnect in "+
 				"%v): %v", *gc.wait, err)
+			noteEvent("IRC server error: %v", err)
 			/* Signal to make a new one next time */
 			newIRC = true
 		}
+		/* Tags aren't used, and would confuse the matching */
+		l = stripTags(l)
+		/* Note which capabilities we got */
+		if m := re.Cap.FindStringSubmatch(l); nil != m {
+			if err = handleCap(irc, m[2], "" != m[3],
+				m[4]); nil != err {
+				quit(irc)
+				newIRC = true
+				break
+			}
+		}
+		/* Send the SASL credentials when asked */
+		if *gc.sasl && re.Authenticate.MatchString(l) {
+			if err = sendSASLPlain(irc); nil != err {
+				err = errors.New(fmt.Sprintf("unable to send "+
+					"SASL credentials: %v", err))
+				quit(irc)
+				newIRC = true
+				break
+			}
+		}
+		/* See if SASL worked */
+		if m := re.SASL.FindStringSubmatch(l); *gc.sasl && nil != m {
+			if err = handleSASLResult(irc, m[2], m[3]); nil != err {
+				quit(irc)
+				newIRC = true
+				break
+			}
+		}
+		/* Register with NickServ if we need to */
+		if m := re.NickServ.FindStringSubmatch(l); nil != m {
+			if err = handleNickServ(irc, m[1]); nil != err {
+				quit(irc)
+				newIRC = true
+				break
+			}
+		}
+		/* Note if we've been opped or voiced */
+		if m := re.Mode.FindStringSubmatch(l); nil != m {
+			handleMode(irc, m[1], m[2], strings.Fields(m[3]))
+		}
+		/* Note how long a nick may be */
+		if m := re.ISupport.FindStringSubmatch(l); nil != m {
+			parseISupport(m[2])
+			if err = refitNick(irc); nil != err {
+				quit(irc)
+				newIRC = true
+				break
+			}
+		}
+		/* Note when the server accepts our registration */
+		if m := re.Welcome.FindStringSubmatch(l); nil != m {
+			verbose("Registered with server as %v", m[2])
+			st.registered = time.Now()
+			st.nick = m[2]
+			st.connfails = 0
+			/* Get our nick back, if it was taken */
+			if st.wantnick {
+				if err = regainNick(irc); nil != err {
+					newIRC = true
+					break
+				}
+			}
+			/* Identify the unusual way, if need be */
+			if nil != st.nscmd {
+				if err = identify(irc); nil != err {
+					newIRC = true
+					break
+				}
+			}
+			/* Set our user modes */
+			if "" != *gc.umodes {
+				debug("Setting user modes %v", *gc.umodes)
+				if err = irc.PrintfLine("MODE %v %v", m[2],
+					*gc.umodes); nil != err {
+					err = errors.New(fmt.Sprintf("unable "+
+						"to set user modes: %v", err))
+					newIRC = true
+					break
+				}
+			}
+			/* Join the channel after a pause, if we're meant to */
+			if 0 != *gc.hsdelay {
+				debug("Waiting %v before joining", *gc.hsdelay)
+				st.joinat = time.Now().Add(*gc.hsdelay)
+			} else if err = joinRegistered(irc); nil != err {
+				newIRC = true
+				break
+			}
+		}
+		/* The server didn't like a user mode */
+		if re.UmodeUnknown.MatchString(l) {
+			verbose("Server refused user modes %v: %v",
+				*gc.umodes, l)
+		}
+		/* Note why we couldn't join, if we can't */
+		if m := re.JoinError.FindStringSubmatch(l); nil != m {
+			if err = handleJoinError(m[2], m[3], l); nil != err {
+				quit(irc)
+				newIRC = true
+				break
+			}
+		}
+		/* Rejoin if we've been kicked, and stop sending if it was
+		from the last channel we were in */
+		if m := re.Kick.FindStringSubmatch(l); nil != m &&
+			isUs(irc, m[3]) && handleKick(m[2], m[1], m[5]) &&
+			!joinedAny() {
+			ircReady = false
+		}
+		/* Keep track of our nick if it's changed */
+		if m := re.Nick.FindStringSubmatch(l); nil != m {
+			if isUs(irc, m[1]) {
+				verbose("Nick changed from %v to %v", m[1],
+					m[2])
+				st.nick = m[2]
+				st.regaining = false
+			}
+			renameAway(m[1], m[2])
+		}
+		/* Make sure a probe found us in the channel */
+		if m := re.ProbeReply.FindStringSubmatch(l); nil != m &&
+			!handleProbeReply(m[2], m[3]) {
+			verbose("Not really in %v (reconnect in %v): %v",
+				*gc.channel, *gc.wait, l)
+			noteEvent("Not really in %v", *gc.channel)
+			quit(irc)
+			st.redial = time.Now().Add(*gc.wait)
+			newIRC = true
+			break
+		}
+		/* Note who's away */
+		if m := re.Away.FindStringSubmatch(l); nil != m {
+			noteAway(m[1], "" != m[3])
+		}
+		/* Catch people up when they join */
+		if m := re.Join.FindStringSubmatch(l); nil != m &&
+			*gc.replay && ircReady {
+			replayTo(irc, m[1])
+		}
+		/* Handle messages from other users */
+		if m := re.Privmsg.FindStringSubmatch(l); nil != m {
+			var rc bool
+			if rc, err = handlePrivmsg(irc, m[1], m[2], m[3],
+				m[4]); nil != err {
+				err = errors.New(fmt.Sprintf("Error "+
+					"handling message from %v: %v", m[2],
+					err))
+				quit(irc)
+				newIRC = true
+				break
+			}
+			if rc {
+				quit(irc)
+				newIRC = true
+				break
+			}
+		}
 		/* Check if we've joined a channel */
-		if re.ChannelJoined.MatchString(l) {
-			debug("Joined a channel: %v", l)
+		/* Note if we've ops or voice already */
+		if m := re.Names.FindStringSubmatch(l); nil != m {
+			handleNames(irc, m[2], strings.Fields(m[3]))
+		}
+		/* A channel's joined once we have all its names */
+		if m := re.EndOfNames.FindStringSubmatch(l); nil != m {
+			noteJoined(m[2])
+		}
+		/* We're ready once we're in any of our channels.  The
+		rest get lines once they're joined. */
+		if !ircReady && joinedAny() {
 			ircReady = true
+			/* Tell ChanServ whatever it needs to know, after
+			giving the server a moment, if we're meant to.  Lines
+			wait as well. */
+			if !st.cssent && 0 != *gc.hsdelay {
+				debug("Waiting %v before sending", *gc.hsdelay)
+				st.csat = time.Now().Add(*gc.hsdelay)
+				st.nextsend = st.csat
+			} else if !st.cssent {
+				if err = sendChanServ(irc); nil != err {
+					newIRC = true
+					break
+				}
+			}
+			/* Say who we are, once */
+			if *gc.sysinfo && !st.sysinfoSent {
+				st.sysinfoSent = true
+				st.outbox = append(st.outbox,
+					lineMessages(irc, sysinfo())...)
+			}
+		}
+		/* Keep the nick we have if we couldn't change it */
+		if m := re.NickError.FindStringSubmatch(l); nil != m &&
+			st.regaining {
+			st.regaining = false
+			verbose("Unable to change nick (%v), keeping %v",
+				m[2], st.nick)
+			break
 		}
 		/* Retry the nick if it's in use */
 		if re.NickInUse.MatchString(l) {
+			/* Try to get it back once we're registered */
+			if *gc.regain && st.registered.IsZero() &&
+				!st.wantnick {
+				st.wantnick = true
+				st.lostnick = irc.SNick()
+			}
+			/* Try the next alternate nick, if there is one */
+			if st.nalt < len(st.altnicks) {
+				a := fitNick(st.altnicks[st.nalt], "")
+				st.nickbase, st.nicksfx = st.altnicks[st.nalt], ""
+				st.nalt++
+				verbose("Nick is in use, will try %v", a)
+				if err = tryNick(irc, a); nil != err {
+					err = errors.New(fmt.Sprintf("unable "+
+						"to try nick %v: %v", a, err))
+					newIRC = true
+				}
+				break
+			}
+			/* If we know how long a nick can be, make sure the
+			numbers fit */
+			if 0 != st.nicklen {
+				n := fitNick(*gc.nick,
+					fmt.Sprintf("%v", rand.Intn(10000)))
+				verbose("Nick is in use, will try %v", n)
+				if err = tryNick(irc, n); nil != err {
+					err = errors.New(fmt.Sprintf("unable "+
+						"to try nick %v: %v", n, err))
+					newIRC = true
+				}
+				break
+			}
 			verbose("Nick is in use, will try another")
-			irc.RandomNumbers = true
+			irc.SetRandomNumbers(true)
 			if err = irc.Handshake(); err != nil {
 				err = errors.New(fmt.Sprintf("unable to "+
 					"retry handshake: %v", err))
 				newIRC = true
 				break
 			}
+			st.nickbase = *gc.nick
+			st.nicksfx = strings.TrimPrefix(irc.SNick(), *gc.nick)
 		}
 	}
 	return
@@ -481,29 +1873,42 @@ func ArrayOfShortStrings(s string, l int) []string {
 		return []string{s}
 	}
 	/* Come up with a guess for the number of smaller strings */
-	nsmaller := int(math.Ceil(float64(len(s) / l)))
+	nsmaller := int(math.Ceil(float64(len(s)) / float64(l)))
 	/* Make an array with a capacity of double that, just in case */
 	o := make([]string, 0, 2*nsmaller)
-	/* Split s into runes */
-	r := []rune(s)
+	/* If nothing needs replacing, just slice up s */
+	if l >= utf8.UTFMax && utf8.ValidString(s) {
+		start := 0 /* Start of the current string */
+		for i := 0; i < len(s); {
+			_, n := utf8.DecodeRuneInString(s[i:])
+			/* If adding the current rune to the current string
+			would be too big, save it and start a new one */
+			if i+n-start > l {
+				o = append(o, s[start:i])
+				start = i
+			}
+			i += n
+		}
+		/* Append the final string */
+		return append(o, s[start:])
+	}
 	/* Working string */
-	w := ""
-	/* Index to r */
-	for i := 0; i < len(r); i++ {
+	var w strings.Builder
+	for _, r := range s {
 		/* If rune is larger than the string size, replace with ? */
-		if len(string(r[i])) > l {
-			r[i] = '?'
+		if utf8.RuneLen(r) > l {
+			r = '?'
 		}
 		/* If adding the current rune to the current string would be
 		too big, save it and start a new one */
-		if len(w+string(r[i])) > l {
-			o = append(o, w)
-			w = ""
+		if w.Len()+utf8.RuneLen(r) > l {
+			o = append(o, w.String())
+			w.Reset()
 		}
-		w += string(r[i])
+		w.WriteRune(r)
 	}
 	/* Append the final working string */
-	return append(o, w)
+	return append(o, w.String())
 }
 
 /* Verbose and debug output */
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArrayOfShortStrings(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		l    int
+		want []string
+	}{
+		{"", 4, []string{""}},
+		{"abc", 4, []string{"abc"}},
+		{"abcd", 4, []string{"abcd"}},
+		{"abcde", 4, []string{"abcd", "e"}},
+		{"abcdefgh", 4, []string{"abcd", "efgh"}},
+		{"abcdefghi", 4, []string{"abcd", "efgh", "i"}},
+		{"abcdefghijkl", 4, []string{"abcd", "efgh", "ijkl"}},
+		{"abc", 1, []string{"a", "b", "c"}},
+		{"aéé", 4, []string{"aé", "é"}},
+		{"日本語", 4, []string{"日", "本", "語"}},
+		{"日本語", 6, []string{"日本", "語"}},
+		{"日本語", 9, []string{"日本語"}},
+		{"日a", 2, []string{"?a"}},
+		{"ab\xffcd", 4, []string{"ab", "\uFFFDc", "d"}},
+	} {
+		if got := ArrayOfShortStrings(c.s, c.l); !reflect.DeepEqual(
+			got, c.want) {
+			t.Errorf("ArrayOfShortStrings(%q, %v): got %q, want "+
+				"%q", c.s, c.l, got, c.want)
+		}
+	}
+}
+
+func BenchmarkArrayOfShortStrings(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		s    string
+	}{
+		{"ASCII", strings.Repeat("The quick brown fox. ", 400)},
+		{"UTF-8", strings.Repeat("日本語のテキスト ", 400)},
+		{"Invalid", strings.Repeat("bad \xff bytes ", 600)},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(int64(len(c.s)))
+			for i := 0; i < b.N; i++ {
+				ArrayOfShortStrings(c.s, 400)
+			}
+		})
+	}
+}
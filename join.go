@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* Reasons for the numerics matched by reJoinError */
+var joinErrors = map[string]string{
+	"403": "no such channel",
+	"405": "joined too many channels",
+	"471": "channel is full",
+	"473": "channel is invite-only",
+	"474": "banned from channel",
+	"475": "wrong channel key",
+	"477": "channel requires an identified nick",
+}
+
+/* Numerics after which the JOIN is retried, unless -persistjoin=false */
+var joinRetryable = map[string]bool{
+	"471": true,
+	"473": true,
+	"474": true,
+	"475": true,
+}
+
+/* handleJoinError handles the server refusing to let us join channel with
+numeric.  For the first channel, the JOIN is retried after -wait if it may
+work later, or an error is returned if -persistjoin=false. */
+func handleJoinError(numeric, channel, line string) error {
+	why := joinErrors[numeric]
+	if noteJoinError(channel, why) {
+		return nil
+	}
+	st.joinerr = why
+	if !joinRetryable[numeric] {
+		debug("Unable to join %v: %v", channel, line)
+		return nil
+	}
+	if !*gc.persjoin {
+		return errors.New(fmt.Sprintf("unable to join %v: %v",
+			channel, why))
+	}
+	verbose("Unable to join %v (retry in %v): %v", channel, *gc.wait,
+		why)
+	st.rejoinat = time.Now().Add(*gc.wait)
+	return nil
+}
+
+/* joinDiagnostic returns the reason the server gave for not letting us join,
+or a list of the likely suspects if it didn't give one. */
+func joinDiagnostic() string {
+	if "" != st.joinerr {
+		return st.joinerr
+	}
+	if ps := pendingExtras(); st.inchan && 0 != len(ps) {
+		return "no reply to JOIN for " + strings.Join(ps, ", ")
+	}
+	if *gc.sasl && !st.saslok {
+		return "SASL never finished; check the server supports it"
+	}
+	return "no reply to JOIN; check the channel name and key, whether " +
+		"the channel needs an identified nick, and whether we're banned"
+}
+
+/* selfJoin returns true if we join the channel ourselves rather than leaving
+it to the library, which is when we have to wait after registering or for
+SASL. */
+func selfJoin() bool {
+	return 0 != *gc.hsdelay || *gc.sasl
+}
+
+/* joinRegistered joins the channels once we're registered and
+-handshake-delay is up */
+func joinRegistered(irc ircConn) error {
+	st.joinat = time.Time{}
+	if selfJoin() {
+		return joinChannel(irc)
+	}
+	return joinExtras(irc)
+}
+
+/* joinChannel joins the channel.  With -handshake-delay or -sasl, the
+library doesn't know the channel, so we join it ourselves, but not before
+registering and authenticating, as that's the job of the 001 and SASL
+handlers. */
+func joinChannel(irc ircConn) error {
+	var err error
+	switch {
+	case !selfJoin():
+		err = irc.Join()
+	case st.registered.IsZero():
+		return nil
+	case !st.joinat.IsZero():
+		debug("Not joining %v until -handshake-delay is up",
+			*gc.channel)
+		return nil
+	case *gc.sasl && !st.saslok:
+		debug("Not joining %v until SASL succeeds", *gc.channel)
+		return nil
+	case "" != *gc.chanpass:
+		err = irc.PrintfLine("JOIN %v %v", *gc.channel, *gc.chanpass)
+	default:
+		err = irc.PrintfLine("JOIN %v", *gc.channel)
+	}
+	if nil != err {
+		return errors.New(fmt.Sprintf("unable to join %v: %v",
+			*gc.channel, err))
+	}
+	return joinExtras(irc)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+/* Kicks closer together than this count towards backing off */
+const kickwindow = 5 * time.Minute
+
+/* handleKick notes that we were kicked from channel by by, for reason why,
+and works out when to rejoin.  It returns true if channel is one of ours. */
+func handleKick(channel, by, why string) (ours bool) {
+	c := extraChannelNamed(channel)
+	switch {
+	case strings.EqualFold(channel, *gc.channel):
+		st.inchan = false
+		st.cssent = false
+		st.opped = false
+		st.voiced = false
+	case nil != c:
+		c.joined = false
+		c.failed = "kicked"
+	default:
+		return false
+	}
+	/* Back off if we keep getting kicked */
+	if time.Since(st.lastkick) < kickwindow {
+		st.nkicks++
+	} else {
+		st.nkicks = 0
+	}
+	st.lastkick = time.Now()
+	d := *gc.rejoin
+	if 0 != st.nkicks && backoff(st.nkicks) > d {
+		d = backoff(st.nkicks)
+	}
+	st.rejoinat = time.Now().Add(d)
+	verbose("Kicked from %v by %v (rejoin in %v): %v", channel, by, d,
+		why)
+	noteEvent("Kicked from %v by %v: %v", channel, by, why)
+	return true
+}
+
+/* rejoinChannels rejoins the channels we've been kicked from or weren't let
+into */
+func rejoinChannels(irc ircConn) error {
+	st.rejoinat = time.Time{}
+	st.rejoined = time.Now()
+	debug("Rejoining %v", *gc.channel)
+	return joinChannel(irc)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/* lockPipe takes an advisory lock on a lockfile next to the pipe named
+pname, so another instance reading the same pipe won't split its lines with
+us.  The lock is held until we exit.  If another process has it, the error
+names its PID.  Lockfiles which are symlinks or aren't ours are refused. */
+func lockPipe(pname string) error {
+	lname := pname + ".lock"
+	/* Already have it */
+	if nil != st.lock && lname == st.lock.Name() {
+		return nil
+	}
+	/* Don't follow a symlink someone's left in a shared directory */
+	f, err := os.OpenFile(lname, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW,
+		0600)
+	if nil != err {
+		return err
+	}
+	/* Nor scribble on somebody else's file */
+	fi, err := f.Stat()
+	if nil != err {
+		f.Close()
+		return err
+	}
+	if !fi.Mode().IsRegular() || !ownedByUs(fi) {
+		f.Close()
+		return errors.New(fmt.Sprintf("%v isn't a regular file "+
+			"owned by us", lname))
+	}
+	if err := syscall.Flock(int(f.Fd()),
+		syscall.LOCK_EX|syscall.LOCK_NB); nil != err {
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		pid := strings.TrimSpace(string(b))
+		if "" == pid {
+			pid = "unknown"
+		}
+		return errors.New(fmt.Sprintf("%v is in use by another "+
+			"instance (PID %v); use -no-lock to share it anyways",
+			pname, pid))
+	}
+	/* Let the next one know who we are */
+	if err := f.Truncate(0); nil != err {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"),
+		0); nil != err {
+		f.Close()
+		return err
+	}
+	/* Let go of the old one, if the pipe changed */
+	unlockPipe(false)
+	st.lock = f
+	debug("Locked %v", lname)
+	return nil
+}
+
+/* unlockPipe lets go of the pipe's lock, if we have it.  If remove is true,
+the lockfile is removed as well. */
+func unlockPipe(remove bool) {
+	if nil == st.lock {
+		return
+	}
+	if remove {
+		if err := os.Remove(st.lock.Name()); nil != err {
+			debug("Unable to remove %v: %v", st.lock.Name(), err)
+		}
+	}
+	st.lock.Close()
+	st.lock = nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+/* toggleMaintenance starts or ends a maintenance pause, during which we won't
+try to reconnect to the IRC server. */
+func toggleMaintenance() {
+	st.paused = !st.paused
+	if st.paused {
+		log.Printf("Maintenance pause: will not reconnect until " +
+			"another SIGUSR2")
+	} else {
+		log.Printf("Maintenance over: reconnecting as usual")
+		/* Connections killed by maintenance don't count, nor does
+		any backoff from before it */
+		st.nshort = 0
+		st.insession = false
+		st.redial = time.Time{}
+	}
+}
+
+/* sleep sleeps for d, or until ctx is cancelled, in which case its error is
+returned */
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
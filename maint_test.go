@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceResetsBackoff(t *testing.T) {
+	setup(t)
+	st.nshort = 5
+	st.redial = time.Now().Add(time.Hour)
+
+	/* Resuming should reconnect straight away */
+	toggleMaintenance()
+	toggleMaintenance()
+	if st.paused {
+		t.Fatalf("Still paused")
+	}
+	if 0 != st.nshort || !st.redial.IsZero() {
+		t.Fatalf("Backoff kept: %v short sessions, redial at %v",
+			st.nshort, st.redial)
+	}
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"net/textproto"
+	"log"
 	"os"
 	"os/exec"
 	"path"
+	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 /*
@@ -37,19 +40,27 @@ import (
  * SOFTWARE.
  */
 
+/* Number of times to reopen a pipe on EOF without reading a line */
+const maxreopens = 10
+
 type Pipe struct {
 	R     <-chan string /* Line channel */
 	r     chan string   /* Writable, closeable R */
 	E     <-chan error  /* Error channel */
 	e     chan error    /* Writable E */
 	Pname string        /* Pipe name */
+	f     *os.File      /* Open pipe, nil for stdin */
+	fl    sync.Mutex    /* Lock for f */
+	done  chan struct{} /* Closed by Close */
+	once  sync.Once     /* Only close done once */
 }
 
 /* makePipe makes or opens a named pipe and returns a channel to which data
 sent to the pipe will be sent.  If flush is true, the pipe will be flushed
 before reads start.  The pipe name is returned for removal before main()
-returns. */
-func makePipe(pname, nick string, flush bool) (*Pipe, error) {
+returns.  The pipe is closed when ctx is cancelled. */
+func makePipe(ctx context.Context, pname, nick string, flush bool) (*Pipe,
+	error) {
 
 	/* Struct to return */
 	p := &Pipe{Pname: pname}
@@ -74,9 +85,16 @@ func makePipe(pname, nick string, flush bool) (*Pipe, error) {
 				"ensure pipe %v exists: %v", p.Pname, err))
 		}
 
+		/* Make sure nobody else is reading it */
+		if !*gc.nolock {
+			if err := lockPipe(p.Pname); nil != err {
+				return nil, err
+			}
+		}
+
 		/* Flush the pipe if desired */
 		if flush {
-			if err := flushPipe(p.Pname); nil != err {
+			if err := flushPipe(ctx, p.Pname); nil != err {
 				return nil, errors.New(fmt.Sprintf("unable "+
 					"to flush pipe %v: %v", p.Pname, err))
 			}
@@ -85,13 +103,13 @@ func makePipe(pname, nick string, flush bool) (*Pipe, error) {
 
 		/* Try to open the pipe RW, to prevent EOFs */
 		var e error
-		rf, e = os.OpenFile(p.Pname, os.O_RDWR, 0600)
+		f, e = os.OpenFile(p.Pname, os.O_RDWR, 0600)
 		if nil != e {
 			return nil, errors.New(fmt.Sprintf("unable to open "+
 				"pipe %v: %v", p.Pname, e))
 		}
 		debug("Opened pipe r/w: %v", p.Pname)
-
+		rf = f
 	}
 
 	/* Make comms channels */
@@ -99,35 +117,158 @@ func makePipe(pname, nick string, flush bool) (*Pipe, error) {
 	p.R = p.r
 	p.e = make(chan error)
 	p.E = p.e
+	p.done = make(chan struct{})
+	p.f = f
+	/* Stop reading when we're told to */
+	go func() {
+		select {
+		case <-ctx.Done():
+			debug("Closing %v: %v", p.Pname, ctx.Err())
+			p.Close()
+		case <-p.done:
+		}
+	}()
 	/* Reader to get lines to put in channel */
-	r := textproto.NewReader(bufio.NewReader(rf))
+	r := bufio.NewReader(rf)
 	go func() {
+		nreopen := 0 /* Reopens since the last line */
 		for {
 			/* Get a line from the reader */
-			line, err := r.ReadLine()
+			line, err := readLine(r, *gc.maxline)
+			/* If the O_RDWR trick didn't work, try again */
+			if io.EOF == err && "-" != p.Pname &&
+				nreopen < maxreopens && !p.closed() {
+				nreopen++
+				var nf *os.File
+				if nf, err = p.reopen(); nil == err {
+					r = bufio.NewReader(nf)
+					continue
+				}
+			}
 			/* Close the channel on error */
 			if nil != err {
+				/* Nobody's listening if we've been closed */
+				if p.closed() {
+					debug("Stopped reading %v", p.Pname)
+					return
+				}
 				/* Send forth the error */
-				p.e <- err
+				select {
+				case p.e <- err:
+				case <-p.done:
+				}
 				/* Close the output channel */
 				close(p.r)
 				/* Close the pipe if not stdin */
-				if "-" != p.Pname {
-					if err := f.Close(); nil != err {
-						verbose("Error closing %v: %v",
-							p.Pname, err)
-					}
-				}
+				p.closeFile()
 				/* Don't send on the closed channel */
 				return
 			}
 			/* Send out the line */
-			p.r <- line
+			nreopen = 0
+			select {
+			case p.r <- line:
+			case <-p.done:
+				debug("Stopped reading %v", p.Pname)
+				return
+			}
 		}
 	}()
 	return p, nil
 }
 
+/* Close stops reading from the pipe and closes it, unless it's stdin, which
+is left open.  Lines not yet read from R are discarded. */
+func (p *Pipe) Close() {
+	p.once.Do(func() { close(p.done) })
+	p.closeFile()
+}
+
+/* closed returns true if Close has been called */
+func (p *Pipe) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+/* closeFile closes the open pipe, if it's not stdin or already closed */
+func (p *Pipe) closeFile() {
+	p.fl.Lock()
+	defer p.fl.Unlock()
+	if nil == p.f {
+		return
+	}
+	if err := p.f.Close(); nil != err {
+		verbose("Error closing %v: %v", p.Pname, err)
+	}
+	p.f = nil
+}
+
+/* reopen closes the pipe and opens it again read-only, for when reading gets
+an EOF despite the pipe having been opened read/write.  This blocks until
+there's a writer. */
+func (p *Pipe) reopen() (*os.File, error) {
+	debug("EOF on %v, reopening", p.Pname)
+	p.closeFile()
+	f, err := os.Open(p.Pname)
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("unable to reopen %v: %v",
+			p.Pname, err))
+	}
+	/* Don't keep it if we were closed in the meantime */
+	p.fl.Lock()
+	defer p.fl.Unlock()
+	if p.closed() {
+		f.Close()
+		return nil, errors.New("closed while reopening")
+	}
+	p.f = f
+	return f, nil
+}
+
+/* readLine reads a line from r, less the trailing \n or \r\n.  Lines longer
+than max bytes are truncated (keeping runes together), and the rest of the
+line discarded, so a runaway writer can't eat all the memory. */
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var b []byte
+	n := 0 /* Length of the whole line */
+	for {
+		/* Get as much of the line as will fit in r's buffer */
+		frag, more, err := r.ReadLine()
+		if nil != err {
+			return "", err
+		}
+		n += len(frag)
+		/* Keep what fits */
+		if len(b) < max {
+			if len(frag) > max-len(b) {
+				frag = frag[:max-len(b)]
+			}
+			b = append(b, frag...)
+		}
+		if !more {
+			break
+		}
+	}
+	/* Warn if we had to drop something */
+	if n > len(b) {
+		/* Don't leave half a rune on the end */
+		for i := len(b) - 1; i >= 0 && len(b)-i < utf8.UTFMax; i-- {
+			if utf8.RuneStart(b[i]) {
+				if !utf8.FullRune(b[i:]) {
+					b = b[:i]
+				}
+				break
+			}
+		}
+		log.Printf("Truncated %v-byte line to %v bytes", n, len(b))
+	}
+	return string(b), nil
+}
+
 /* createPipe ensures that a pipe named pname exists */
 func createPipe(pname string) error {
 MakePipe:
@@ -145,18 +286,23 @@ MakePipe:
 		goto MakePipe /* Neener neener */
 	case nil != err: /* Error calling stat() */
 		return errors.New(fmt.Sprintf("unable to get stat "+
-			"information for %v: %v", pname, gc.wait, err))
+			"information for %v: %v", pname, err))
 	case 0 == fi.Mode()&os.ModeNamedPipe: /* pname is not a pipe */
 		return errors.New(fmt.Sprintf("%v exists but is not a pipe",
 			pname))
+	case !*gc.pinsecure && !ownedByUs(fi): /* Someone else's pipe */
+		return errors.New(fmt.Sprintf("%v exists but is owned by "+
+			"uid %v, not us (uid %v)", pname, fileOwner(fi),
+			os.Getuid()))
 	default: /* All is good */
 		debug("%v exists and is a pipe", pname)
 	}
 	return nil
 }
 
-/* flushPipe flushes data from the pipe named pname */
-func flushPipe(pname string) error {
+/* flushPipe flushes data from the pipe named pname, giving up if ctx is
+cancelled */
+func flushPipe(ctx context.Context, pname string) error {
 	var cmd *exec.Cmd = nil
 	/* Put data on the pipe in case it's empty */
 	for nil == cmd {
@@ -164,7 +310,7 @@ func flushPipe(pname string) error {
 		if cmd, err = forkSaveHelp(pname); nil != err {
 			return errors.New(fmt.Sprintf("unable to start "+
 				"command to put flushable data into %v: %v",
-				pname, gc.wait, err))
+				pname, err))
 		}
 	}
 	debug("Started %v", cmd.Args)
@@ -194,9 +340,12 @@ FlushLoop:
 					pname, e)
 				break FlushLoop
 			}
-		case <-time.After(*gc.wait):
+		case <-time.After(*gc.ftimeout):
 			verbose("Timed out after %v while flushing %v",
-				*gc.wait, pname)
+				*gc.ftimeout, pname)
+			break FlushLoop
+		case <-ctx.Done():
+			debug("Stopped flushing %v: %v", pname, ctx.Err())
 			break FlushLoop
 		}
 	}
@@ -250,3 +399,19 @@ func forkSaveHelp(fname string) (*exec.Cmd, error) {
 	}
 	return c, nil
 }
+
+/* ownedByUs returns true if fi describes a file owned by our uid */
+func ownedByUs(fi os.FileInfo) bool {
+	return int64(os.Getuid()) == fileOwner(fi)
+}
+
+/* fileOwner returns the uid which owns the file described by fi, or -1 if
+it can't be determined */
+func fileOwner(fi os.FileInfo) int64 {
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		debug("Unable to determine the owner of %v", fi.Name())
+		return -1
+	}
+	return int64(sys.Uid)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* TestMain stands in for the -savehelp child flushPipe starts, which would
+otherwise be the test binary not knowing -savehelp.  It writes a line and then
+holds the pipe open, like a writer which never finishes. */
+func TestMain(m *testing.M) {
+	if 3 == len(os.Args) && "-savehelp" == os.Args[1] {
+		f, err := os.OpenFile(os.Args[2], os.O_WRONLY, 0)
+		if nil != err {
+			os.Exit(1)
+		}
+		f.Write([]byte("help\n"))
+		time.Sleep(5 * time.Second)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+/* testPipe makes a pipe in a temporary directory and returns its name */
+func testPipe(t *testing.T) string {
+	pname := filepath.Join(t.TempDir(), "pipe")
+	if err := createPipe(pname); nil != err {
+		t.Fatalf("Unable to make pipe: %v", err)
+	}
+	return pname
+}
+
+/* waitGoroutines waits a bit for there to be no more than n goroutines, and
+fails if there's still more */
+func waitGoroutines(t *testing.T, n int) {
+	for i := 0; i < 200; i++ {
+		if runtime.NumGoroutine() <= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%v goroutines, not %v", runtime.NumGoroutine(), n)
+}
+
+func TestFlushTimeout(t *testing.T) {
+	setup(t, "-wait", "1h", "-flush-timeout", "100ms")
+	pname := testPipe(t)
+
+	/* A long -wait shouldn't hold up flushing */
+	start := time.Now()
+	if err := flushPipe(context.Background(), pname); nil != err {
+		t.Fatalf("Unable to flush %v: %v", pname, err)
+	}
+	if d := time.Since(start); 2*time.Second < d {
+		t.Fatalf("Flushing took %v", d)
+	}
+}
+
+func TestFlushCancel(t *testing.T) {
+	setup(t, "-flush-timeout", "1h")
+	pname := testPipe(t)
+
+	/* Cancelling should stop flushing */
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := flushPipe(ctx, pname); nil != err {
+		t.Fatalf("Unable to flush %v: %v", pname, err)
+	}
+	if d := time.Since(start); 2*time.Second < d {
+		t.Fatalf("Flushing took %v after cancelling", d)
+	}
+}
+
+func TestPipeCancel(t *testing.T) {
+	setup(t, "-no-lock")
+	pname := testPipe(t)
+	n := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := makePipe(ctx, pname, "", false)
+	if nil != err {
+		t.Fatalf("Unable to make pipe: %v", err)
+	}
+
+	/* Leave the reader stuck with a line nobody's reading */
+	w, err := os.OpenFile(pname, os.O_WRONLY, 0)
+	if nil != err {
+		t.Fatalf("Unable to open %v for writing: %v", pname, err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte("line\n")); nil != err {
+		t.Fatalf("Unable to write to %v: %v", pname, err)
+	}
+
+	/* Cancelling should close the pipe and stop its goroutines */
+	cancel()
+	waitGoroutines(t, n)
+	if !p.closed() {
+		t.Fatalf("Pipe not closed after cancelling")
+	}
+}
+
+func TestPipeCycle(t *testing.T) {
+	setup(t, "-no-lock")
+	pname := testPipe(t)
+	n := runtime.NumGoroutine()
+
+	/* Reopening the pipe, as on SIGHUP or an error, shouldn't leave the
+	old readers behind, even if they're stuck on a line */
+	for i := 0; i < 20; i++ {
+		p, err := makePipe(context.Background(), pname, "", false)
+		if nil != err {
+			t.Fatalf("Unable to make pipe: %v", err)
+		}
+		w, err := os.OpenFile(pname, os.O_WRONLY, 0)
+		if nil != err {
+			t.Fatalf("Unable to open %v for writing: %v", pname,
+				err)
+		}
+		if _, err := w.Write([]byte("line\n")); nil != err {
+			t.Fatalf("Unable to write to %v: %v", pname, err)
+		}
+		w.Close()
+		p.Close()
+	}
+	waitGoroutines(t, n)
+}
+
+func TestCreatePipeOwner(t *testing.T) {
+	if 0 != os.Getuid() {
+		t.Skip("Need to be root to give away the pipe")
+	}
+	setup(t)
+	pname := testPipe(t)
+	if err := os.Chown(pname, 12345, -1); nil != err {
+		t.Fatalf("Unable to chown %v: %v", pname, err)
+	}
+
+	/* The error should say who does own it */
+	err := createPipe(pname)
+	if nil == err {
+		t.Fatalf("Accepted someone else's pipe")
+	}
+	if !strings.Contains(err.Error(), "owned by uid 12345, not us "+
+		"(uid 0)") {
+		t.Fatalf("Unhelpful error: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+/* maxmuted is the most lines buffered while muted.  Beyond this, the oldest
+lines are dropped. */
+const maxmuted = 1000
+
+/* setMute mutes or unmutes output.  why says who asked. */
+func setMute(mute bool, why string) {
+	if mute == st.muted {
+		return
+	}
+	st.muted = mute
+	if st.muted {
+		if *gc.mutedrop {
+			log.Printf("Muted by %v: dropping lines until unmuted",
+				why)
+		} else {
+			log.Printf("Muted by %v: buffering lines until "+
+				"unmuted", why)
+		}
+		return
+	}
+	log.Printf("Unmuted by %v, %v buffered lines to send", why,
+		len(st.mutebuf))
+}
+
+/* muteLine buffers l while muted, or drops it if -mute-drop was given */
+func muteLine(l string) {
+	if *gc.mutedrop {
+		debug("Muted, dropping %q", l)
+		return
+	}
+	st.mutebuf = append(st.mutebuf, l)
+	st.mutebytes += len(l)
+	for 0 != len(st.mutebuf) && (maxmuted < len(st.mutebuf) ||
+		(0 < *gc.mbufbytes && *gc.mbufbytes < st.mutebytes)) {
+		debug("Mute buffer full, dropping %q", st.mutebuf[0])
+		dropMuted()
+	}
+}
+
+/* dropMuted removes the oldest line from the mute buffer */
+func dropMuted() {
+	st.mutebytes -= len(st.mutebuf[0])
+	st.mutebuf = st.mutebuf[1:]
+}
+
+/* queueMuted queues the oldest line buffered while muted, if we're unmuted
+and the outbox is empty.  Buffered lines are sent one at a time this way, so
+nothing else waits on a big buffer. */
+func queueMuted(irc ircConn) {
+	if st.muted || outboxBusy() || 0 == len(st.mutebuf) {
+		return
+	}
+	queueLine(irc, st.mutebuf[0], false)
+	dropMuted()
+}
+
+/* muteStatus describes the mute state, for !status */
+func muteStatus() string {
+	if !st.muted {
+		return "not muted"
+	}
+	return fmt.Sprintf("muted (%v lines, %v bytes buffered)",
+		len(st.mutebuf), st.mutebytes)
+}
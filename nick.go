@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* Nick length to assume for nicks made before connecting, which is what
+freenode allows */
+const nicklen = 16
+
+/* fitNick returns base with suffix appended, shortening base as needed to
+fit in the server's NICKLEN.  The suffix is never shortened.  Until we know
+NICKLEN, nothing is shortened; refitNick shortens it later if need be. */
+func fitNick(base, suffix string) string {
+	return fitNickTo(base, suffix, st.nicklen)
+}
+
+/* fitNickTo is like fitNick, but fits the nick in l bytes.  If l is 0,
+nothing is shortened. */
+func fitNickTo(base, suffix string, l int) string {
+	if max := l - len(suffix); 0 != l && len(base) > max && 0 < max {
+		base = base[:max]
+	}
+	return base + suffix
+}
+
+/* refitNick asks for the nick we last tried again, shortened to fit, once the
+server's told us its NICKLEN.  The nick's made before then, and the server
+may have cut the end off, suffix and all. */
+func refitNick(irc ircConn) error {
+	want := st.nickbase + st.nicksfx
+	if 0 == st.nicklen || len(want) <= st.nicklen {
+		return nil
+	}
+	n := fitNick(st.nickbase, st.nicksfx)
+	st.nickbase, st.nicksfx = "", ""
+	if strings.EqualFold(n, ourNick(irc)) {
+		return nil
+	}
+	verbose("Nick %v is longer than the server allows, will try %v",
+		want, n)
+	/* If it's taken, keep the one we have */
+	st.regaining = true
+	if err := irc.PrintfLine("NICK :%v", n); nil != err {
+		return errors.New(fmt.Sprintf("unable to send NICK: %v", err))
+	}
+	return nil
+}
+
+/* parseISupport notes anything interesting from the parameters of a 005
+(RPL_ISUPPORT) message */
+func parseISupport(params string) {
+	for _, p := range strings.Fields(params) {
+		if strings.HasPrefix(p, ":") {
+			break
+		}
+		if !strings.HasPrefix(p, "NICKLEN=") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(p, "NICKLEN="))
+		if nil != err || 0 >= n {
+			debug("Ignoring invalid %v", p)
+			continue
+		}
+		st.nicklen = n
+		debug("Server allows nicks up to %v bytes", n)
+	}
+}
+
+/* tryNick asks the server for the nick n, and then re-auths to services and
+re-joins the channel, as either may have been refused before the nick was
+accepted. */
+func tryNick(irc ircConn, n string) error {
+	debug("Requesting nick %v", n)
+	if err := irc.PrintfLine("NICK :%v", n); nil != err {
+		return errors.New(fmt.Sprintf("unable to send NICK: %v", err))
+	}
+	if err := identify(irc); nil != err {
+		return err
+	}
+	return joinChannel(irc)
+}
+
+/* nickFromHost derives a nick from the local hostname, according to how,
+which is one of the values allowed by -nick-from. */
+func nickFromHost(how string) (string, error) {
+	h, err := os.Hostname()
+	if nil != err {
+		return "", err
+	}
+	short := strings.SplitN(h, ".", 2)[0]
+	f := fnv.New32a()
+	f.Write([]byte(h))
+	suffix := fmt.Sprintf("-%04x", f.Sum32()&0xFFFF)
+	switch how {
+	case "short":
+		return short, nil
+	case "fqdn":
+		/* If it's too long, keep it unique with the hash */
+		n := strings.Replace(h, ".", "-", -1)
+		if len(n) > nicklen {
+			n = fitNickTo(n, suffix, nicklen)
+		}
+		return n, nil
+	case "hash":
+		/* Shorten the name to leave room for the hash */
+		return fitNickTo(short, suffix, nicklen), nil
+	default:
+		return "", errors.New(fmt.Sprintf("unknown -nick-from %q",
+			how))
+	}
+}
+
+/* flagSet returns true if the flag named name was given on the command
+line */
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if name == f.Name {
+			set = true
+		}
+	})
+	return set
+}
+
+/* ourNick returns our current nick, as best we know it */
+func ourNick(irc ircConn) string {
+	if "" != st.nick {
+		return st.nick
+	}
+	return irc.SNick()
+}
+
+/* isUs returns true if nick is our current nick */
+func isUs(irc ircConn, nick string) bool {
+	return strings.EqualFold(nick, ourNick(irc))
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestFitNickTo(t *testing.T) {
+	for _, c := range []struct {
+		base   string
+		suffix string
+		l      int
+		want   string
+	}{
+		{"averylongnick", "", 0, "averylongnick"},
+		{"averylongnick", "1234", 0, "averylongnick1234"},
+		{"averylongnick", "", 9, "averylong"},
+		{"averylongnick", "1234", 9, "avery1234"},
+		{"averylongnick", "1234", 5, "a1234"},
+		{"nick", "1234", 9, "nick1234"},
+		{"nick", "", 1, "n"},
+	} {
+		if got := fitNickTo(c.base, c.suffix, c.l); c.want != got {
+			t.Errorf("fitNickTo(%q, %q, %v): got %q, want %q",
+				c.base, c.suffix, c.l, got, c.want)
+		}
+	}
+}
+
+func TestParseISupport(t *testing.T) {
+	for _, c := range []struct {
+		params string
+		want   int
+	}{
+		{"CHANTYPES=# NICKLEN=9 :are supported by this server", 9},
+		{"NICKLEN=1 :are supported by this server", 1},
+		{"NICKLEN=0 :are supported by this server", 0},
+		{"NICKLEN=-3 :are supported by this server", 0},
+		{"NICKLEN=x :are supported by this server", 0},
+		{"CHANTYPES=# :NICKLEN=9", 0},
+	} {
+		setup(t)
+		if parseISupport(c.params); c.want != st.nicklen {
+			t.Errorf("%q: got NICKLEN %v, want %v", c.params,
+				st.nicklen, c.want)
+		}
+	}
+}
+
+func TestRefitNick(t *testing.T) {
+	setup(t, "-nick", "averylongnick")
+	f := newFakeIRC("averylongnick1234")
+	st.nick = ""
+	st.nickbase, st.nicksfx = "averylongnick", "1234"
+
+	/* A short NICKLEN should get us a shorter nick, numbers intact */
+	event(t, f, ":srv 005 averylongnick1234 NICKLEN=9 :are supported",
+		false)
+	if 1 != len(f.sent) || "NICK :avery1234" != f.sent[0] {
+		t.Fatalf("Bad refit, sent %q", f.sent)
+	}
+	if !st.regaining {
+		t.Fatalf("Not expecting the nick change")
+	}
+
+	/* Being refused should keep the nick we have */
+	event(t, f, ":srv 433 averylongnick1234 avery1234 :Nickname is "+
+		"already in use", false)
+	if st.regaining || 1 != len(f.sent) {
+		t.Fatalf("Tried again after a refused refit, sent %q", f.sent)
+	}
+
+	/* A nick which fits shouldn't be changed */
+	setup(t, "-nick", "nick")
+	f = newFakeIRC("nick1234")
+	st.nick = ""
+	st.nickbase, st.nicksfx = "nick", "1234"
+	event(t, f, ":srv 005 nick1234 NICKLEN=9 :are supported", false)
+	if 0 != len(f.sent) {
+		t.Fatalf("Refit a nick which fits, sent %q", f.sent)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/* Time to wait for the paste service */
+const pastetimeout = 10 * time.Second
+
+/* Longest paste service response we'll believe is a URL */
+const maxpasteurl = 1024
+
+/* paste uploads l to -paste-url and returns the URL of the paste */
+func paste(l string) (string, error) {
+	c := &http.Client{Timeout: pastetimeout}
+	res, err := c.PostForm(*gc.pasteurl, url.Values{*gc.pastefld: {l}})
+	if nil != err {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", errors.New(fmt.Sprintf("unexpected status %v",
+			res.Status))
+	}
+	/* The body should be the URL */
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, maxpasteurl))
+	if nil != err {
+		return "", errors.New(fmt.Sprintf("unable to read "+
+			"response: %v", err))
+	}
+	u := strings.TrimSpace(string(b))
+	if "" == u {
+		return "", errors.New("empty response")
+	}
+	debug("Pasted %v bytes to %v", len(l), u)
+	return u, nil
+}
+
+/* pasted is the result of pasting a line in the background */
+type pasted struct {
+	line   string /* Line which was pasted */
+	n      int    /* Messages the line would have taken */
+	replay bool   /* Line's from -fallback-file */
+	url    string /* Paste's URL */
+	err    error  /* Why the paste failed, if it did */
+}
+
+/* startPaste pastes l, which would take n messages, in the background, as
+the paste service may be slow.  The result is sent on st.pastec, for
+queuePasted. */
+func startPaste(l string, n int, replay bool) {
+	c := make(chan pasted, 1)
+	st.pastec = c
+	go func() {
+		u, err := paste(l)
+		c <- pasted{line: l, n: n, replay: replay, url: u, err: err}
+	}()
+}
+
+/* queuePasted queues a link to the paste p, or the line itself if pasting
+failed */
+func queuePasted(irc ircConn, p pasted) {
+	st.pastec = nil
+	max := messageSize(irc)
+	if nil != p.err {
+		verbose("Unable to paste %v-message line: %v", p.n, p.err)
+		queueParts(p.line, splitMessage(p.line, max), p.replay)
+		return
+	}
+	queueParts(p.line, splitMessage(fmt.Sprintf("Pasted %v-message "+
+		"line: %v", p.n, p.url), max), p.replay)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "strings"
+
+/* handlePrivmsg handles a PRIVMSG from from (nick!user@host) with nick nick to
+target.  Our own messages, echoed back by the server or a bouncer, are
+ignored.  If the message asks for a reconnect, reconnect will be true. */
+func handlePrivmsg(irc ircConn, from, nick, target, text string) (
+	reconnect bool, err error) {
+	/* Don't talk to ourselves */
+	if isUs(irc, nick) {
+		checkEcho(target, text)
+		debug("Ignoring our own message to %v: %v", target, text)
+		return false, nil
+	}
+	/* Save what's said in the channel */
+	if strings.EqualFold(target, *gc.channel) {
+		st.recorder.Record(nick, text)
+	}
+	/* CTCP queries aren't commands, but some want answers */
+	if c, a, ok := parseCTCP(text); ok {
+		return false, handleCTCP(irc, nick, c, a)
+	}
+	/* Commands from admins */
+	if 0 != len(st.admins) {
+		if reconnect, err = handleAdmin(irc, from, nick,
+			text); nil != err || reconnect {
+			return reconnect, err
+		}
+	}
+	return false, nil
+}
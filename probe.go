@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+/* nextProbe returns the time at which the next -probe-every probe is due, or
+if one's been sent, the time by which it needs a reply. */
+func nextProbe() time.Time {
+	if !st.probesent.IsZero() {
+		return st.probesent.Add(*gc.probewait)
+	}
+	t := st.connected
+	if st.lastprobe.After(t) {
+		t = st.lastprobe
+	}
+	return t.Add(*gc.probeint)
+}
+
+/* sendProbe asks for the channel's topic, which the server should answer
+if we're really in the channel */
+func sendProbe(irc ircConn) error {
+	debug("Probing %v", *gc.channel)
+	st.probesent = time.Now()
+	st.lastprobe = st.probesent
+	return withWriteTimeout(func() error {
+		return irc.PrintfLine("TOPIC %v", *gc.channel)
+	})
+}
+
+/* handleProbeReply handles a reply with the numeric num about channel to a
+probe.  It returns false if the reply says we're not really in the
+channel. */
+func handleProbeReply(num, channel string) bool {
+	if st.probesent.IsZero() || !strings.EqualFold(channel, *gc.channel) {
+		return true
+	}
+	debug("Probe reply after %v: %v", time.Since(st.probesent), num)
+	st.probesent = time.Time{}
+	/* 442 is ERR_NOTONCHANNEL */
+	return "442" != num
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"text/template"
+	"time"
+)
+
+/* parseQuitMessage parses m as a template for the quit message.  If m isn't a
+valid template, nil is returned and m will be used as-is. */
+func parseQuitMessage(m string) *template.Template {
+	t, err := template.New("qmsg").Funcs(templateFuncs).Parse(m)
+	if nil != err {
+		debug("Quit message is not a template: %v", err)
+		return nil
+	}
+	return t
+}
+
+/* quitMessage renders the quit message with the current stats.  If the quit
+message isn't a template or can't be rendered, it is returned unchanged. */
+func quitMessage() string {
+	if nil == st.qmsg {
+		return *gc.qmsg
+	}
+	/* Work out how long we've been connected */
+	var u time.Duration
+	if !st.connected.IsZero() {
+		u = time.Since(st.connected) / time.Second * time.Second
+	}
+	b := &bytes.Buffer{}
+	if err := st.qmsg.Execute(b, struct {
+		Uptime     time.Duration
+		Lines      uint64
+		Reconnects uint64
+	}{u, st.lines, st.reconnects}); nil != err {
+		debug("Unable to render quit message: %v", err)
+		return *gc.qmsg
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package main
+
+import "time"
+
+/* ratewindow is the window over which -rate is enforced */
+const ratewindow = time.Minute
+
+/* rateWait returns how long to wait before sending another message to keep
+to -rate.  It's 0 if -rate wasn't given or there's room in the window. */
+func rateWait() time.Duration {
+	pruneSent()
+	if 0 >= *gc.rate || len(st.sent) < *gc.rate {
+		return 0
+	}
+	/* Wait until enough old messages fall out of the window */
+	return st.sent[len(st.sent)-*gc.rate].Add(ratewindow).Sub(time.Now())
+}
+
+/* noteSent notes that a message was sent, for -rate */
+func noteSent() {
+	st.sent = append(st.sent, time.Now())
+	pruneSent()
+}
+
+/* pruneSent removes the times of messages sent before the window */
+func pruneSent() {
+	cutoff := time.Now().Add(-ratewindow)
+	i := 0
+	for ; i < len(st.sent) && st.sent[i].Before(cutoff); i++ {
+	}
+	st.sent = st.sent[i:]
+}
+
+/* observedRate returns the number of messages sent in the last minute */
+func observedRate() int {
+	pruneSent()
+	return len(st.sent)
+}
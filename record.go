@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+/* maxrecordq is the most lines waiting to be written to -record.  More than
+this and lines are dropped rather than hold up the main loop. */
+const maxrecordq = 1000
+
+/* recorder appends lines said in the channel to a file, rotating it when it
+gets too big */
+type recorder struct {
+	fname string      /* File name */
+	max   int64       /* Rotate once the file's this big */
+	f     *os.File    /* Open file */
+	size  int64       /* Size of f */
+	c     chan string /* Lines to write */
+}
+
+/* startRecorder opens -record and starts a goroutine to write lines to it.
+If -record wasn't given, it returns nil. */
+func startRecorder() (*recorder, error) {
+	if "" == *gc.record {
+		return nil, nil
+	}
+	r := &recorder{
+		fname: *gc.record,
+		max:   *gc.recmax,
+		c:     make(chan string, maxrecordq),
+	}
+	if err := r.open(); nil != err {
+		return nil, err
+	}
+	go r.write()
+	return r, nil
+}
+
+/* Record queues a line said by sender in the channel for writing.  If too
+many lines are queued, it's dropped. */
+func (r *recorder) Record(sender, text string) {
+	if nil == r {
+		return
+	}
+	l := fmt.Sprintf("%v %v: %v", time.Now().Format(time.RFC3339),
+		sender, text)
+	if "" != *gc.signkey {
+		l += " [" + checkSignature(sender, text) + "]"
+	}
+	select {
+	case r.c <- l:
+	default:
+		debug("Too many lines waiting for %v, dropping %q", r.fname,
+			l)
+	}
+}
+
+/* open opens the file, appending to it if it exists */
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if nil != err {
+		return err
+	}
+	fi, err := f.Stat()
+	if nil != err {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+/* rotate moves the file to fname.1, replacing any older one, and starts a
+new one */
+func (r *recorder) rotate() error {
+	r.f.Close()
+	if err := os.Rename(r.fname, r.fname+".1"); nil != err {
+		return errors.New(fmt.Sprintf("unable to rotate %v: %v",
+			r.fname, err))
+	}
+	debug("Rotated %v", r.fname)
+	return r.open()
+}
+
+/* write writes queued lines to the file */
+func (r *recorder) write() {
+	for l := range r.c {
+		if 0 < r.max && r.size >= r.max {
+			if err := r.rotate(); nil != err {
+				verbose("Stopped recording: %v", err)
+				return
+			}
+		}
+		n, err := fmt.Fprintln(r.f, l)
+		r.size += int64(n)
+		if nil != err {
+			verbose("Error recording to %v: %v", r.fname, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/* regainwait is how long to give NickServ to kill whatever has our nick */
+const regainwait = 2 * time.Second
+
+/* regainNick asks NickServ to GHOST whatever has the nick we first asked for,
+and arranges to ask for it back after regainwait.  It's only tried once a
+connection, after registering under another nick, as NickServ won't talk to
+us before then.  If the nick's still taken, we keep the one we have. */
+func regainNick(irc ircConn) error {
+	st.wantnick = false
+	verbose("Asking NickServ to ghost %v", st.lostnick)
+	if err := irc.PrintfLine("PRIVMSG NickServ :GHOST %v %v", st.lostnick,
+		*gc.idpass); nil != err {
+		return errors.New(fmt.Sprintf("unable to send GHOST: %v", err))
+	}
+	st.regainat = time.Now().Add(regainwait)
+	return nil
+}
+
+/* reclaimNick asks for the nick regainNick ghosted */
+func reclaimNick(irc ircConn) error {
+	st.regainat = time.Time{}
+	st.regaining = true
+	if err := irc.PrintfLine("NICK :%v", st.lostnick); nil != err {
+		return errors.New(fmt.Sprintf("unable to send NICK: %v", err))
+	}
+	return nil
+}
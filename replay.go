@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+/* Most lines -replay-lines may ask for */
+const maxreplay = 50
+
+/* Don't replay to the same nick more than once in this long */
+const replaywindow = 10 * time.Minute
+
+/* Don't replay to anybody more than once in this long */
+const replaygap = 30 * time.Second
+
+/* remember adds l to the lines to be replayed to joiners, forgetting the
+oldest if there are too many. */
+func remember(l string) {
+	if !*gc.replay {
+		return
+	}
+	n := *gc.nreplay
+	if n > maxreplay {
+		n = maxreplay
+	}
+	st.recent = append(st.recent, l)
+	if len(st.recent) > n {
+		st.recent = st.recent[len(st.recent)-n:]
+	}
+}
+
+/* replayTo queues the recently-sent lines to be sent to nick as NOTICEs,
+unless nick is us, was replayed to recently, or someone else was replayed to
+very recently. */
+func replayTo(irc ircConn, nick string) {
+	/* Don't bother with ourselves or with nothing */
+	if isUs(irc, nick) || 0 == len(st.recent) {
+		return
+	}
+	/* Nor anybody who's not there to read it */
+	if isAway(nick) {
+		debug("Not replaying to %v, who's away", nick)
+		return
+	}
+	/* Don't let a join/part loop flood anybody */
+	if nil == st.replayed {
+		st.replayed = make(map[string]time.Time)
+	}
+	for k, t := range st.replayed {
+		if time.Since(t) >= replaywindow {
+			delete(st.replayed, k)
+		}
+	}
+	k := strings.ToLower(nick)
+	if time.Since(st.replayed[k]) < replaywindow ||
+		time.Since(st.lastreplay) < replaygap {
+		debug("Not replaying to %v so soon", nick)
+		return
+	}
+	st.replayed[k] = time.Now()
+	st.lastreplay = time.Now()
+	verbose("Replaying %v lines to %v", len(st.recent), nick)
+	max := irc.PrivmsgSize(nick)
+	for _, l := range st.recent {
+		for _, m := range splitMessage(l, max) {
+			st.outbox = append(st.outbox, outMsg{
+				text:   m,
+				target: nick,
+				notice: true,
+			})
+		}
+	}
+}
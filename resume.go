@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+/* resumeNotice notes that a line was read, and returns -resume-notice if it
+came more than -resume-after since the previous one.  The first line read
+never gets a notice. */
+func resumeNotice() string {
+	last := st.lastinput
+	st.lastinput = time.Now()
+	if 0 == *gc.resumegap || last.IsZero() ||
+		time.Since(last) < *gc.resumegap {
+		return ""
+	}
+	b := &bytes.Buffer{}
+	if err := st.resume.Execute(b, struct {
+		Gap time.Duration
+	}{time.Since(last) / time.Second * time.Second}); nil != err {
+		debug("Unable to render resume notice: %v", err)
+		return ""
+	}
+	return b.String()
+}
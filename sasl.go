@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+/* Longest chunk of base64 in an AUTHENTICATE line */
+const maxauthenticate = 400
+
+/* Reasons for SASL failure numerics */
+var saslErrors = map[string]string{
+	"902": "nick is locked",
+	"904": "authentication failed",
+	"905": "credentials too long",
+	"906": "authentication aborted",
+}
+
+/* handleSASLCap starts SASL PLAIN authentication once the server has ACK'd
+the sasl capability.  If it NAK'd it or doesn't offer it, an error is returned
+rather than falling back to NickServ. */
+func handleSASLCap(irc ircConn) error {
+	if !*gc.sasl || st.saslreq {
+		return nil
+	}
+	on, ok := st.caps["sasl"]
+	if !ok {
+		return nil
+	}
+	if !on && !st.capls["sasl"] {
+		return errors.New("server doesn't offer SASL")
+	}
+	if !on {
+		return errors.New("server refused SASL")
+	}
+	st.saslreq = true
+	debug("Starting SASL PLAIN authentication as %v", *gc.idnick)
+	return irc.PrintfLine("AUTHENTICATE PLAIN")
+}
+
+/* sendSASLPlain sends the credentials, in chunks if they're long, after the
+server's AUTHENTICATE + */
+func sendSASLPlain(irc ircConn) error {
+	c := base64.StdEncoding.EncodeToString(
+		[]byte("\x00" + *gc.idnick + "\x00" + *gc.idpass),
+	)
+	for {
+		n := len(c)
+		if maxauthenticate < n {
+			n = maxauthenticate
+		}
+		if err := irc.PrintfLine("AUTHENTICATE %v", c[:n]); nil != err {
+			return err
+		}
+		c = c[n:]
+		/* A full last chunk needs an empty one to say it's done */
+		if maxauthenticate > n {
+			return nil
+		}
+		if 0 == len(c) {
+			return irc.PrintfLine("AUTHENTICATE +")
+		}
+	}
+}
+
+/* handleSASLResult handles the numeric which ends authentication.  On
+success, capability negotiation is ended, if nothing else is pending, and the
+channel joined.  On failure, an error is returned. */
+func handleSASLResult(irc ircConn, numeric, text string) error {
+	if "903" != numeric && "907" != numeric {
+		return errors.New(fmt.Sprintf("SASL %v: %v",
+			saslErrors[numeric], text))
+	}
+	verbose("Authenticated with SASL as %v", *gc.idnick)
+	st.saslok = true
+	if err := endCaps(irc); nil != err {
+		return err
+	}
+	return joinChannel(irc)
+}
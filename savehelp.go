@@ -1,24 +1,69 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 )
 
+/* helpFlag describes a flag in the JSON help text */
+type helpFlag struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
 /* saveHelp writes the help text to a file */
 func saveHelp(fname string) int {
+	/* Make sure we know the format */
+	if "text" != *gc.shformat && "json" != *gc.shformat {
+		fmt.Printf("Unknown -savehelp-format %q\n", *gc.shformat)
+		return exitSaveHelp
+	}
 	/* Open output file */
 	f, err := os.Create(fname)
 	if err != nil {
 		fmt.Printf("Unable to open %v to write help text: %v\n", fname,
 			err)
-		return -9
+		return exitSaveHelp
 	}
 	debug("Opened %v for saving help", fname)
+	/* JSON for tooling */
+	if "json" == *gc.shformat {
+		if err := json.NewEncoder(f).Encode(helpFlags()); nil != err {
+			fmt.Printf("Unable to write help text to %v: %v\n",
+				fname, err)
+			return exitSaveHelp
+		}
+		debug("Saved JSON help text to %v", fname)
+		return exitOK
+	}
 	flag.CommandLine.SetOutput(f)
 	debug("Set output to %v", f)
 	flag.PrintDefaults()
 	debug("Saved help text to %v", fname)
-	return 0
+	return exitOK
+}
+
+/* helpFlags describes all of the flags */
+func helpFlags() []helpFlag {
+	fs := []helpFlag{}
+	flag.VisitAll(func(f *flag.Flag) {
+		t, u := flag.UnquoteUsage(f)
+		/* Bools don't get a type name */
+		if b, ok := f.Value.(interface {
+			IsBoolFlag() bool
+		}); ok && b.IsBoolFlag() {
+			t = "bool"
+		}
+		fs = append(fs, helpFlag{
+			Name:    f.Name,
+			Type:    t,
+			Default: f.DefValue,
+			Usage:   u,
+		})
+	})
+	return fs
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/* readSecretFile reads a password or key from the file named fname, less any
+trailing newline. */
+func readSecretFile(fname string) (string, error) {
+	b, err := ioutil.ReadFile(fname)
+	if nil != err {
+		return "", errors.New(fmt.Sprintf("unable to read %v: %v",
+			fname, err))
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+/* redact returns a stand-in for the secret s, suitable for logging */
+func redact(s string) string {
+	if "" == s {
+		return "(none)"
+	}
+	return "(redacted)"
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+/* Shortest delay -senddelay-jitter may make */
+const minsenddelay = 250 * time.Millisecond
+
+/* sendDelay returns -senddelay, randomly changed by up to -senddelay-jitter
+if it was given */
+func sendDelay() time.Duration {
+	d := *gc.senddelay
+	if 0 >= *gc.jitter {
+		return d
+	}
+	/* Somewhere between -jitter and +jitter */
+	d += time.Duration(rand.Int63n(2*int64(*gc.jitter)+1)) - *gc.jitter
+	/* But not too short */
+	min := minsenddelay
+	if *gc.senddelay < min {
+		min = *gc.senddelay
+	}
+	if d < min {
+		d = min
+	}
+	return d
+}
+
+/* outMsg is a message waiting in the outbox to be sent to IRC */
+type outMsg struct {
+	text   string /* Message, ready to send */
+	target string /* Where to send it, or "" for the channel */
+	notice bool   /* Send as a NOTICE, not a PRIVMSG */
+	mirror bool   /* Send to the mirrors as well, once sent */
+	replay bool   /* Replayed from -fallback-file, so -replay-delay */
+	last   bool   /* Last message for line */
+	line   string /* Line the message came from, if last */
+}
+
+/* lineMessages splits l into messages short enough for IRC, one for each
+part of the line for each channel we're in. */
+func lineMessages(irc ircConn, l string) []outMsg {
+	return partMessages(splitMessage(l, messageSize(irc)))
+}
+
+/* messageSize returns the longest message which fits in every channel we're
+in, less room for the hostname, signature, and CTCP framing */
+func messageSize(irc ircConn) int {
+	ts := messageTargets()
+	max := irc.PrivmsgSize(ts[0])
+	for _, t := range ts[1:] {
+		if n := irc.PrivmsgSize(t); n < max {
+			max = n
+		}
+	}
+	max -= len(hostPrefix()) + signLen()
+	if *gc.action {
+		max -= len(ctcpAction(""))
+	}
+	return max
+}
+
+/* messageTargets returns the targets for messages, which are the channels
+we're in, or just the first channel if we're in none */
+func messageTargets() []string {
+	ts := joinTargets()
+	if 0 == len(ts) {
+		ts = []string{""}
+	}
+	return ts
+}
+
+/* partMessages makes the messages for the parts of a line.  Each part goes
+to every channel, and the mirrors with the first. */
+func partMessages(parts []string) []outMsg {
+	p := hostPrefix()
+	ts := messageTargets()
+	ms := make([]outMsg, 0, len(parts)*len(ts))
+	for _, m := range parts {
+		for i, t := range ts {
+			ms = append(ms, outMsg{
+				text:   p + m,
+				target: t,
+				mirror: 0 == i,
+			})
+		}
+	}
+	return ms
+}
+
+/* queueLine adds the messages for l to the outbox, paced by -replay-delay if
+replay is true.  The line's counted as sent once its last message is.  If it'd
+take more than -paste-over messages, it's pasted in the background instead,
+and queued by queuePasted when that's done. */
+func queueLine(irc ircConn, l string, replay bool) {
+	parts := splitMessage(l, messageSize(irc))
+	if 0 < *gc.pasteover && len(parts) > *gc.pasteover {
+		startPaste(l, len(parts), replay)
+		return
+	}
+	queueParts(l, parts, replay)
+}
+
+/* queueParts adds the messages for parts, which came from l, to the
+outbox */
+func queueParts(l string, parts []string, replay bool) {
+	ms := partMessages(parts)
+	for i := range ms {
+		ms[i].replay = replay
+	}
+	ms[len(ms)-1].last = true
+	ms[len(ms)-1].line = l
+	st.outbox = append(st.outbox, ms...)
+}
+
+/* outboxBusy returns true if there are messages waiting to be sent, or a
+line waiting to be pasted, either of which should be sent before anything
+else is queued */
+func outboxBusy() bool {
+	return 0 != len(st.outbox) || nil != st.pastec
+}
+
+/* sendQueued sends the first message in the outbox, if -rate allows, and
+works out when to send the next one.  If sending fails, the message stays in
+the outbox to be tried again, unless it's failed too often to keep trying on
+this connection, in which case an error is returned. */
+func sendQueued(irc ircConn) error {
+	if 0 == len(st.outbox) {
+		return nil
+	}
+	/* Keep to -rate */
+	if d := rateWait(); 0 < d {
+		debug("Waiting %v to keep to %v messages per %v", d,
+			*gc.rate, ratewindow)
+		st.nextsend = time.Now().Add(d)
+		return nil
+	}
+	m := st.outbox[0]
+	var err error
+	if m.notice {
+		err = notice(irc, m.text, m.target)
+	} else {
+		err = (ircSink{irc, m.target}).Send(m.text)
+	}
+	if m.replay {
+		st.nextsend = time.Now().Add(replayDelay())
+	} else {
+		st.nextsend = time.Now().Add(sendDelay())
+	}
+	if nil != err {
+		if retrySend(err) {
+			return nil
+		}
+		return err
+	}
+	st.sendfails = 0
+	st.outbox = st.outbox[1:]
+	noteSent()
+	/* And everywhere else */
+	if m.mirror {
+		for _, s := range st.mirrors {
+			if err := s.Send(m.text); nil != err {
+				verbose("Error mirroring message to %v: %v",
+					s, err)
+			}
+		}
+	}
+	if m.last {
+		remember(m.line)
+		st.lines++
+		st.lastsent = time.Now()
+	}
+	return nil
+}
+
+/* hostPrefix returns the short hostname to put in front of each message, if
+-hostprefix was given */
+func hostPrefix() string {
+	if !*gc.hostpfx || "" == st.hostname {
+		return ""
+	}
+	return "[" + strings.SplitN(st.hostname, ".", 2)[0] + "] "
+}
+
+/* splitMessage splits s into messages no longer than l bytes, as asked by
+the flags */
+func splitMessage(s string, l int) []string {
+	split := ArrayOfShortStrings
+	if *gc.clusters {
+		split = ArrayOfShortClusters
+	}
+	if "word" == *gc.wrap {
+		return ArrayOfShortStringsWrapped(s, l, split)
+	}
+	return split(s, l)
+}
+
+/* privmsg sends m to target (or the channel, if target is empty), giving up
+if the send takes longer than -write-timeout.  If -tags was given and the
+server supports it, the message will be tagged. */
+func privmsg(irc ircConn, m, target string) error {
+	return withWriteTimeout(func() error {
+		if *gc.tags && st.caps["message-tags"] {
+			return taggedPrivmsg(irc, m, target)
+		}
+		return irc.Privmsg(m, target)
+	})
+}
+
+/* notice sends m to target (or the channel, if target is empty) as a NOTICE,
+giving up if the send takes longer than -write-timeout. */
+func notice(irc ircConn, m, target string) error {
+	if "" == target {
+		target = *gc.channel
+	}
+	return withWriteTimeout(func() error {
+		return irc.PrintfLine("NOTICE %v :%v", target, m)
+	})
+}
+
+/* quit sends a QUIT to the IRC server, giving up if it takes longer than
+-write-timeout.  Errors are logged, as there's not much else to do with
+them. */
+func quit(irc ircConn) {
+	if err := withWriteTimeout(func() error {
+		return irc.Quit(quitMessage())
+	}); nil != err {
+		debug("Error closing connection to the IRC server: %v", err)
+	}
+}
+
+/* withWriteTimeout calls f, but returns an error if f doesn't return within
+-write-timeout.  This keeps a half-closed connection from wedging the whole
+program.  If f times out, it will be left running in the background until
+whatever it's stuck on gives up. */
+func withWriteTimeout(f func() error) error {
+	/* A timeout of 0 means wait forever */
+	if 0 == *gc.wtimeout {
+		return f()
+	}
+	/* Buffered so that a late f doesn't block forever */
+	c := make(chan error, 1)
+	go func() { c <- f() }()
+	select {
+	case err := <-c:
+		return err
+	case <-time.After(*gc.wtimeout):
+		return errors.New(fmt.Sprintf("timed out after %v",
+			*gc.wtimeout))
+	}
+}
+
+/* retrySend notes that sending failed with err, and returns true if it's
+worth trying again on the same connection, which is until -send-failures
+failures in a row or until sending's been failing for -send-failure-window,
+whichever comes first. */
+func retrySend(err error) bool {
+	now := time.Now()
+	if 0 == st.sendfails {
+		st.firstfail = now
+	}
+	st.sendfails++
+	if st.sendfails >= *gc.sendfails || (0 < *gc.sfwindow &&
+		now.Sub(st.firstfail) >= *gc.sfwindow) {
+		st.sendfails = 0
+		return false
+	}
+	verbose("Error sending message (%v of %v failures before "+
+		"reconnecting): %v", st.sendfails, *gc.sendfails, err)
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTimeout(t *testing.T) {
+	setup(t, "-write-timeout", "50ms")
+	f := newFakeIRC("testnick")
+	f.block = make(chan bool)
+	defer close(f.block)
+
+	/* A write which never finishes should time out */
+	start := time.Now()
+	if err := privmsg(f, "hello", "#test"); nil == err {
+		t.Fatalf("No error from a stuck write")
+	}
+	if d := time.Since(start); time.Second < d {
+		t.Fatalf("Stuck write took %v to time out", d)
+	}
+
+	/* And the line should stay queued until sending's given up on */
+	queueLine(f, "hello", false)
+	if err := sendQueued(f); nil == err {
+		t.Fatalf("No error sending to a stuck server")
+	}
+	if 1 != len(st.outbox) {
+		t.Fatalf("Outbox has %v messages, not 1", len(st.outbox))
+	}
+}
+
+/* testSink is a Sink which remembers what it's sent */
+type testSink struct {
+	sent *[]string
+}
+
+func (s testSink) Send(line string) error {
+	*s.sent = append(*s.sent, line)
+	return nil
+}
+
+func TestActionFraming(t *testing.T) {
+	setup(t, "-action")
+	f := newFakeIRC("testnick")
+	f.size = 30
+	var mirrored []string
+	st.mirrors = []Sink{testSink{&mirrored}}
+
+	/* Each part of a long line is its own action, framing and all, and
+	still fits in a message */
+	l := "deployed v1.2.3 to all of the production hosts"
+	queueLine(f, l, false)
+	for 0 != len(st.outbox) {
+		if err := sendQueued(f); nil != err {
+			t.Fatalf("Error sending %q: %v", l, err)
+		}
+	}
+	if 2 > len(f.sent) {
+		t.Fatalf("Line not split, sent %q", f.sent)
+	}
+	var got string
+	for _, s := range f.sent {
+		m := strings.TrimPrefix(s, "PRIVMSG  :")
+		if f.size < len(m) {
+			t.Errorf("Message %q longer than %v", m, f.size)
+		}
+		c, a, ok := parseCTCP(m)
+		if !ok || "ACTION" != c || !strings.HasSuffix(m, ctcpdelim) {
+			t.Fatalf("Message %q isn't an action", m)
+		}
+		got += a
+	}
+	if l != got {
+		t.Fatalf("Sent %q, not %q", got, l)
+	}
+
+	/* The mirrors get the parts without the framing */
+	if l != strings.Join(mirrored, "") {
+		t.Fatalf("Mirrored %q", mirrored)
+	}
+
+	/* An empty line is still a valid action */
+	f.sent = nil
+	queueLine(f, "", false)
+	sendQueued(f)
+	if 1 != len(f.sent) || "PRIVMSG  :\x01ACTION \x01" != f.sent[0] {
+		t.Fatalf("Empty line sent as %q", f.sent)
+	}
+}
+
+func TestPasteInBackground(t *testing.T) {
+	/* A paste service which takes its time */
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			fmt.Fprintln(w, "https://paste.example/1")
+		},
+	))
+	defer srv.Close()
+	setup(t, "-paste-over", "2", "-paste-url", srv.URL)
+	f := newFakeIRC("testnick")
+	f.size = 10
+
+	/* Queueing the line shouldn't wait for the paste */
+	queueLine(f, strings.Repeat("x", 50), false)
+	if 0 != len(st.outbox) || !outboxBusy() {
+		t.Fatalf("Line not being pasted, outbox: %v", st.outbox)
+	}
+
+	/* Once it's done, the link's queued */
+	close(release)
+	_, _, _, err := handleEvent(context.Background(), nil, f, true)
+	if nil != err {
+		t.Fatalf("Error waiting for the paste: %v", err)
+	}
+	var got string
+	for _, m := range st.outbox {
+		got += m.text
+	}
+	if want := "Pasted 5-message line: https://paste.example/1"; want !=
+		got {
+		t.Fatalf("Queued %q, not %q", got, want)
+	}
+	if outboxBusy() != (0 != len(st.outbox)) {
+		t.Fatalf("Still waiting for the paste")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/* How long to hold lines waiting for ChanServ to op or voice us */
+const csmodewait = 10 * time.Second
+
+/* Channel modes which always take an argument.  l takes one only when
+being set. */
+const argmodes = "ovhaqbeIk"
+
+/* parseCommand parses text, which is the value of the flag named name, as
+a template for a raw IRC line.  If text is empty, nil is returned. */
+func parseCommand(name, text string) (*template.Template, error) {
+	if "" == text {
+		return nil, nil
+	}
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+/* sendCommand renders the command template t and sends it to the server.
+mode is only used by -cs-mode-command. */
+func sendCommand(irc ircConn, t *template.Template, mode string) error {
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, struct {
+		Nick    string
+		IdNick  string
+		Pass    string
+		Channel string
+		Key     string
+		Mode    string
+		Email   string
+	}{
+		ourNick(irc),
+		*gc.idnick,
+		*gc.idpass,
+		*gc.channel,
+		*gc.chanpass,
+		mode,
+		*gc.regemail,
+	}); nil != err {
+		return errors.New(fmt.Sprintf("unable to render %v: %v",
+			t.Name(), err))
+	}
+	/* Passwords are likely in there */
+	debug("Sending %v", t.Name())
+	if err := irc.PrintfLine("%v", b.String()); nil != err {
+		return errors.New(fmt.Sprintf("unable to send %v: %v",
+			t.Name(), err))
+	}
+	return nil
+}
+
+/* passwordFromPipe returns true if the services password would have to be
+read from the standard input, which is also -pipe */
+func passwordFromPipe() bool {
+	return "" != *gc.idnick && "" == *gc.idpass && "-" == *gc.pipe
+}
+
+/* identify identifies to services with -ns-command if it was given, or the
+usual way if not.  As services won't talk to us before we're registered,
+-ns-command is only sent once we are; the 001 handler takes care of it
+otherwise. */
+func identify(irc ircConn) error {
+	if nil != st.nscmd {
+		if st.registered.IsZero() {
+			return nil
+		}
+		return sendCommand(irc, st.nscmd, "")
+	}
+	if err := irc.Auth(); nil != err {
+		return errors.New(fmt.Sprintf("unable to auth: %v", err))
+	}
+	return nil
+}
+
+/* sendChanServ tells ChanServ whatever it needs to know, once per
+connection */
+func sendChanServ(irc ircConn) error {
+	st.csat = time.Time{}
+	st.cssent = true
+	return tellChanServ(irc)
+}
+
+/* tellChanServ sends -cs-command and asks for ops and voice, as requested,
+after joining the channel */
+func tellChanServ(irc ircConn) error {
+	if nil != st.cscmd {
+		if err := sendCommand(irc, st.cscmd, ""); nil != err {
+			return err
+		}
+	}
+	if *gc.csop {
+		if err := sendCommand(irc, st.csmcmd, "OP"); nil != err {
+			return err
+		}
+	}
+	if *gc.csvoice {
+		if err := sendCommand(irc, st.csmcmd, "VOICE"); nil != err {
+			return err
+		}
+	}
+	/* Hold lines until they'll get through */
+	if !haveModes() {
+		debug("Waiting up to %v for ChanServ to set our modes",
+			csmodewait)
+		st.modeat = time.Now().Add(csmodewait)
+	}
+	return nil
+}
+
+/* haveModes returns true if we have the ops or voice asked for with -cs-op
+and -cs-voice.  Ops will do instead of voice. */
+func haveModes() bool {
+	return (!*gc.csop || st.opped) &&
+		(!*gc.csvoice || st.voiced || st.opped)
+}
+
+/* handleMode notes whether a MODE change for target, with the given modes
+and arguments, gives or takes away our ops or voice in the channel */
+func handleMode(irc ircConn, target, modes string, args []string) {
+	if !strings.EqualFold(target, *gc.channel) {
+		return
+	}
+	add := true
+	for _, c := range strings.TrimPrefix(modes, ":") {
+		switch c {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+		/* Work out the argument, if the mode takes one */
+		if !strings.ContainsRune(argmodes, c) && !(add && 'l' == c) {
+			continue
+		}
+		if 0 == len(args) {
+			return
+		}
+		a := strings.TrimPrefix(args[0], ":")
+		args = args[1:]
+		if !isUs(irc, a) {
+			continue
+		}
+		switch c {
+		case 'o':
+			st.opped = add
+			verbose("Ops in %v: %v", target, add)
+		case 'v':
+			st.voiced = add
+			verbose("Voice in %v: %v", target, add)
+		}
+	}
+	/* Send lines once ChanServ's done its thing */
+	if !st.modeat.IsZero() && haveModes() {
+		debug("ChanServ set our modes, sending lines")
+		st.modeat = time.Time{}
+	}
+}
+
+/* handleNames notes our ops or voice from the names in a 353 (RPL_NAMREPLY)
+for channel */
+func handleNames(irc ircConn, channel string, names []string) {
+	if !strings.EqualFold(channel, *gc.channel) {
+		return
+	}
+	for _, n := range names {
+		/* Split off the prefixes, of which there may be several */
+		nick := strings.TrimLeft(n, "~&@%+")
+		if !isUs(irc, nick) {
+			continue
+		}
+		prefixes := n[:len(n)-len(nick)]
+		st.opped = strings.ContainsAny(prefixes, "~&@")
+		st.voiced = strings.Contains(prefixes, "+")
+		debug("Our prefixes in %v: %q", channel, prefixes)
+		return
+	}
+}
+
+/* chanStatus describes our ops and voice in the channel, for !status */
+func chanStatus() string {
+	switch {
+	case st.opped:
+		return "opped"
+	case st.voiced:
+		return "voiced"
+	default:
+		return "not opped or voiced"
+	}
+}
+
+/* handleNickServ registers our nick if text, a NOTICE from NickServ, says
+it's not registered and -register was given.  Other notices about
+registration are logged. */
+func handleNickServ(irc ircConn, text string) error {
+	if !*gc.register {
+		return nil
+	}
+	t := strings.ToLower(text)
+	switch {
+	case strings.Contains(t, "already registered"):
+		verbose("NickServ: %v", text)
+	case strings.Contains(t, "not registered") ||
+		strings.Contains(t, "isn't registered"):
+		if st.regsent {
+			return nil
+		}
+		st.regsent = true
+		verbose("Registering nick %v with NickServ", ourNick(irc))
+		return sendCommand(irc, st.regcmd, "")
+	case st.regsent && strings.Contains(t, "registered"):
+		verbose("NickServ: %v", text)
+	}
+	return nil
+}
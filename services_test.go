@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestPasswordFromPipe(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"-idnick", "bot", "-pipe", "-"}, true},
+		{[]string{"-idnick", "bot", "-idpass", "pw", "-pipe", "-"},
+			false},
+		{[]string{"-idnick", "bot", "-pipe", "/tmp/pipe"}, false},
+		{[]string{"-pipe", "-"}, false},
+	} {
+		setup(t, c.args...)
+		if got := passwordFromPipe(); c.want != got {
+			t.Errorf("%q: got %v, want %v", c.args, got, c.want)
+		}
+	}
+}
+
+func TestChanServModeWait(t *testing.T) {
+	setup(t, "-cs-voice", "-channel", "#test")
+	var err error
+	if st.csmcmd, err = parseCommand("cs-mode-command",
+		*gc.csmcmd); nil != err {
+		t.Fatalf("Unable to parse -cs-mode-command: %v", err)
+	}
+	f := newFakeIRC("testnick")
+
+	/* Lines should wait for the voice we asked for */
+	event(t, f, ":srv 366 testnick #test :End of /NAMES list.", false)
+	if !f.sentLine("PRIVMSG ChanServ :VOICE #test testnick") {
+		t.Fatalf("Didn't ask for voice, sent %q", f.sent)
+	}
+	if st.modeat.IsZero() {
+		t.Fatalf("Not waiting for voice")
+	}
+
+	/* Someone else's voice shouldn't do */
+	event(t, f, ":ChanServ!s@s MODE #test +v other", true)
+	if st.modeat.IsZero() {
+		t.Fatalf("Stopped waiting after someone else was voiced")
+	}
+	event(t, f, ":ChanServ!s@s MODE #test +v testnick", true)
+	if !st.voiced || !st.modeat.IsZero() {
+		t.Fatalf("Still waiting after being voiced")
+	}
+
+	/* Having it already means there's nothing to wait for */
+	setup(t, "-cs-voice", "-channel", "#test")
+	st.csmcmd, _ = parseCommand("cs-mode-command", *gc.csmcmd)
+	event(t, f, ":srv 353 testnick = #test :+testnick", false)
+	event(t, f, ":srv 366 testnick #test :End of /NAMES list.", false)
+	if !st.modeat.IsZero() {
+		t.Fatalf("Waiting for voice we already have")
+	}
+}
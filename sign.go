@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+/* Signatures are this many hex digits, after sigsep */
+const (
+	siglen = 12
+	sigsep = " ~"
+)
+
+/* signature returns the truncated HMAC of m, as sent by nick, with
+-sign-key.  The nick's in the HMAC so one host's messages can't be passed off
+as another's. */
+func signature(nick, m string) string {
+	h := hmac.New(sha256.New, []byte(*gc.signkey))
+	h.Write([]byte(nick + "\x00" + m))
+	return hex.EncodeToString(h.Sum(nil))[:siglen]
+}
+
+/* sign appends m's signature to m, if -sign-key was given.  It's called
+for each message as it's sent, so the signature covers the message as the
+channel sees it, less any CTCP framing. */
+func sign(m string) string {
+	if "" == *gc.signkey {
+		return m
+	}
+	return m + sigsep + signature(st.nick, m)
+}
+
+/* signLen returns the number of bytes sign adds to a message */
+func signLen() int {
+	if "" == *gc.signkey {
+		return 0
+	}
+	return len(sigsep) + siglen
+}
+
+/* checkSignature describes whether text, sent by nick, carries a valid
+signature, for -record.  CTCP ACTIONs are checked without their framing. */
+func checkSignature(nick, text string) string {
+	if c, a, ok := parseCTCP(text); ok && "ACTION" == c {
+		text = a
+	}
+	i := strings.LastIndex(text, sigsep)
+	if -1 == i || len(sigsep)+siglen != len(text)-i {
+		return "unsigned"
+	}
+	if !hmac.Equal([]byte(text[i+len(sigsep):]),
+		[]byte(signature(nick, text[:i]))) {
+		return "BAD SIGNATURE"
+	}
+	return "signed"
+}
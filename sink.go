@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+/* Time to wait for -mirror-url to respond */
+const mirrortimeout = 10 * time.Second
+
+/* Most messages waiting to be POSTed to -mirror-url */
+const mirrorqueue = 100
+
+/* Sink is somewhere messages can be sent.  Send is called once per message,
+after splitting. */
+type Sink interface {
+	Send(line string) error
+}
+
+/* ircSink sends messages to the channel, or to target if it's set */
+type ircSink struct {
+	irc    ircConn
+	target string
+}
+
+/* Send sends line to the channel, signed if -sign-key was given and as an
+action if -action was given */
+func (s ircSink) Send(line string) error {
+	line = sign(line)
+	if *gc.action {
+		line = ctcpAction(line)
+	}
+	if err := privmsg(s.irc, line, s.target); nil != err {
+		return err
+	}
+	if "" == s.target {
+		noteUnechoed(line)
+	}
+	return nil
+}
+
+/* fileSink appends messages to a file */
+type fileSink struct {
+	f *os.File
+}
+
+/* Send appends line and a newline to the file */
+func (s fileSink) Send(line string) error {
+	_, err := fmt.Fprintln(s.f, line)
+	return err
+}
+
+/* String returns the name of the file */
+func (s fileSink) String() string {
+	return s.f.Name()
+}
+
+/* urlSink POSTs messages to a URL.  The POSTs are made in the background, so
+a slow server doesn't hold anything up. */
+type urlSink struct {
+	url string
+	q   chan string
+}
+
+/* newURLSink returns a urlSink which POSTs to u, and starts the goroutine
+which does the POSTing */
+func newURLSink(u string) urlSink {
+	s := urlSink{url: u, q: make(chan string, mirrorqueue)}
+	go s.post(&http.Client{Timeout: mirrortimeout})
+	return s
+}
+
+/* Send queues line to be POSTed to the URL as text.  If too many are already
+waiting, line is dropped and an error returned. */
+func (s urlSink) Send(line string) error {
+	select {
+	case s.q <- line:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("%v messages already waiting, "+
+			"dropping message", mirrorqueue))
+	}
+}
+
+/* post POSTs the queued messages with c, logging errors, as there's nobody
+to return them to */
+func (s urlSink) post(c *http.Client) {
+	for line := range s.q {
+		res, err := c.Post(s.url, "text/plain; charset=utf-8",
+			bytes.NewBufferString(line))
+		if nil != err {
+			verbose("Error mirroring message to %v: %v", s, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			verbose("Error mirroring message to %v: unexpected "+
+				"status %v", s, res.Status)
+		}
+	}
+}
+
+/* String returns the URL */
+func (s urlSink) String() string {
+	return s.url
+}
+
+/* stdoutSink writes messages to the standard output, after a marker */
+type stdoutSink struct {
+	marker string
+}
+
+/* Send writes the marker, line, and a newline to the standard output */
+func (s stdoutSink) Send(line string) error {
+	_, err := fmt.Printf("%v%v\n", s.marker, line)
+	return err
+}
+
+/* String returns "stdout" */
+func (s stdoutSink) String() string {
+	return "stdout"
+}
+
+/* mirrorSinks returns the non-IRC sinks requested by -mirror-file,
+-mirror-url, and -stdout */
+func mirrorSinks() ([]Sink, error) {
+	ss := []Sink{}
+	if "" != *gc.mfile {
+		f, err := os.OpenFile(*gc.mfile,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if nil != err {
+			return nil, errors.New(fmt.Sprintf("unable to open "+
+				"%v: %v", *gc.mfile, err))
+		}
+		debug("Mirroring to file %v", f.Name())
+		ss = append(ss, fileSink{f})
+	}
+	if "" != *gc.murl {
+		debug("Mirroring to URL %v", *gc.murl)
+		ss = append(ss, newURLSink(*gc.murl))
+	}
+	if *gc.stdout {
+		debug("Mirroring to stdout")
+		ss = append(ss, stdoutSink{*gc.stdoutmrk})
+	}
+	return ss, nil
+}
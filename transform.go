@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* A transform changes a line read from the input before it's sent.  If keep
+is false, the line is dropped. */
+type transform interface {
+	Transform(line string) (out string, keep bool)
+}
+
+/* transformFunc is a function which is a transform */
+type transformFunc func(line string) (string, bool)
+
+/* Transform calls f */
+func (f transformFunc) Transform(line string) (string, bool) {
+	return f(line)
+}
+
+/* transforms are the transforms -transform may name */
+var transforms = map[string]transformFunc{
+	/* Drop empty and whitespace-only lines */
+	"skip-blank": func(l string) (string, bool) {
+		if "" == strings.TrimSpace(l) {
+			debug("Skipping blank line")
+			return l, false
+		}
+		return l, true
+	},
+	/* Note if the input's been quiet for a while */
+	"resume": func(l string) (string, bool) {
+		if n := resumeNotice(); "" != n {
+			l = n + " " + l
+		}
+		return l, true
+	},
+	/* Fold the prefix if it's the same as the last line's */
+	"fold": func(l string) (string, bool) {
+		return foldPrefix(l), true
+	},
+	/* Say when the line was read */
+	"timestamp": func(l string) (string, bool) {
+		return time.Now().Format(*gc.tsprefix) + " " + l, true
+	},
+	/* Number the line */
+	"seq": func(l string) (string, bool) {
+		st.seq++
+		return fmt.Sprintf("[%v] %v", st.seq, l), true
+	},
+	/* Say which instance this is */
+	"instance": func(l string) (string, bool) {
+		return st.instance + l, true
+	},
+	/* Add the footer to every -footer-every'th line */
+	"footer": func(l string) (string, bool) {
+		st.nfooter++
+		if 0 >= *gc.footernth || 0 != st.nfooter%*gc.footernth {
+			return l, true
+		}
+		return l + " " + *gc.footer, true
+	},
+}
+
+/* transformNames returns the names of the transforms, sorted */
+func transformNames() []string {
+	ns := make([]string, 0, len(transforms))
+	for n := range transforms {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+/* defaultTransforms returns the names of the transforms turned on by their
+own flags, in the order they've always been done */
+func defaultTransforms() []string {
+	ns := []string{}
+	if *gc.skipblank {
+		ns = append(ns, "skip-blank")
+	}
+	if 0 != *gc.resumegap {
+		ns = append(ns, "resume")
+	}
+	if *gc.fold {
+		ns = append(ns, "fold")
+	}
+	if "" != *gc.tsprefix {
+		ns = append(ns, "timestamp")
+	}
+	if *gc.seq {
+		ns = append(ns, "seq")
+	}
+	if "" != st.instance {
+		ns = append(ns, "instance")
+	}
+	if 0 < *gc.footernth {
+		ns = append(ns, "footer")
+	}
+	return ns
+}
+
+/* parseTransforms builds the transform chain from -transform, or from the
+individual flags if -transform wasn't given */
+func parseTransforms() ([]transform, error) {
+	ns := defaultTransforms()
+	if "" != *gc.transform {
+		ns = strings.Split(*gc.transform, ",")
+	}
+	ts := make([]transform, 0, len(ns))
+	for _, n := range ns {
+		n = strings.TrimSpace(n)
+		t, ok := transforms[n]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unknown "+
+				"transform %q", n))
+		}
+		/* Some need a bit more config */
+		switch {
+		case "resume" == n && 0 == *gc.resumegap:
+			return nil, errors.New("resume needs -resume-after")
+		case "footer" == n && 0 >= *gc.footernth:
+			return nil, errors.New("footer needs -footer-every")
+		case "timestamp" == n && "" == *gc.tsprefix:
+			return nil, errors.New("timestamp needs -tsprefix")
+		}
+		ts = append(ts, t)
+	}
+	debug("Transforms: %v", ns)
+	return ts, nil
+}
+
+/* transformLine runs l through the transforms.  If keep is false, the line
+should be dropped. */
+func transformLine(l string) (string, bool) {
+	for _, t := range st.transforms {
+		var keep bool
+		if l, keep = t.Transform(l); !keep {
+			return l, false
+		}
+	}
+	return l, true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+/* maxunechoed is the most sent messages remembered while waiting for the
+server to echo them back */
+const maxunechoed = 100
+
+/* noteUnechoed remembers m, sent to the channel, to check against its echo
+if -verify-length was given and the server echoes messages */
+func noteUnechoed(m string) {
+	if !*gc.verifylen || !st.caps["echo-message"] {
+		return
+	}
+	st.unechoed = append(st.unechoed, m)
+	if maxunechoed < len(st.unechoed) {
+		st.unechoed = st.unechoed[len(st.unechoed)-maxunechoed:]
+	}
+}
+
+/* checkEcho compares text, an echo of a message we sent to target, against
+what was sent, and warns if the server cut it short */
+func checkEcho(target, text string) {
+	if !*gc.verifylen || !strings.EqualFold(target, *gc.channel) ||
+		0 == len(st.unechoed) {
+		return
+	}
+	m := st.unechoed[0]
+	st.unechoed = st.unechoed[1:]
+	if len(text) < len(m) && strings.HasPrefix(m, text) {
+		log.Printf("Server truncated a %v-byte message to %v bytes; "+
+			"the server's line length limit may be lower than "+
+			"expected: %q", len(m), len(text), text)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "strings"
+
+/* ArrayOfShortStringsWrapped is like ArrayOfShortStrings, but breaks at the
+last space which keeps each string no longer than l bytes, if there is one.
+Spaces at the break are removed.  Words longer than l bytes are split with
+split, and the rest of the word starts the next string. */
+func ArrayOfShortStringsWrapped(s string, l int,
+	split func(string, int) []string) []string {
+	/* Easy case, string fits */
+	if len(s) <= l {
+		return []string{s}
+	}
+	o := []string{}
+	for len(s) > l {
+		/* Break at the last space, if it's not at the start */
+		if i := strings.LastIndex(s[:l+1], " "); 0 < i {
+			if w := strings.TrimRight(s[:i], " "); "" != w {
+				o = append(o, w)
+				s = strings.TrimLeft(s[i:], " ")
+				continue
+			}
+		}
+		/* The first word's too long for a string */
+		s = strings.TrimLeft(s, " ")
+		j := strings.Index(s, " ")
+		if -1 == j {
+			j = len(s)
+		}
+		ps := split(s[:j], l)
+		o = append(o, ps[:len(ps)-1]...)
+		s = ps[len(ps)-1] + s[j:]
+	}
+	/* Append the final string, unless the break ate it */
+	if "" != s {
+		o = append(o, s)
+	}
+	return o
+}